@@ -2,59 +2,243 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/effectivemobile/subscriptions/internal/auth"
 	"github.com/effectivemobile/subscriptions/internal/config"
 	"github.com/effectivemobile/subscriptions/internal/handlers"
+	"github.com/effectivemobile/subscriptions/internal/health"
+	"github.com/effectivemobile/subscriptions/internal/logging"
+	"github.com/effectivemobile/subscriptions/internal/metrics"
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/effectivemobile/subscriptions/internal/ratelimit"
+	"github.com/effectivemobile/subscriptions/internal/rates"
 	"github.com/effectivemobile/subscriptions/internal/store"
+	"github.com/effectivemobile/subscriptions/internal/tlsconfig"
+	"github.com/effectivemobile/subscriptions/internal/tracing"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/sirupsen/logrus"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
 )
 
+// bound of flushing the spans of the last requests on shutdown
+const traceFlushTimeout = 5 * time.Second
+
 func main() {
 	log := logrus.New()
+	log.AddHook(tracing.LogHook{})
+	if err := run(log); err != nil {
+		log.Fatal(err)
+	}
+	log.Info("server stopped")
+}
 
+// run serves until SIGTERM or SIGINT and shuts down gracefully: /readyz fails
+// first, then in-flight requests are drained and only then are the tracer and
+// the database stopped; a second signal kills the process at once
+func run(log *logrus.Logger) error {
 	cfg, err := config.LoadConfig()
 	if err != nil {
-		log.Fatalf("failed to load config: %v", err)
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := logging.Configure(log, cfg.Log.Level, cfg.Log.Format); err != nil {
+		return fmt.Errorf("invalid log config: %w", err)
 	}
 	log.Infof("starting subscriptions service on %s", cfg.Server.Address)
 
 	db, err := sqlx.Connect("postgres", cfg.Postgres.DSN())
 	if err != nil {
-		log.Fatalf("can't connect to db: %v", err)
+		return fmt.Errorf("can't connect to db: %w", err)
 	}
-	defer db.Close()
+	// deferred calls run in reverse, so the database is closed last
+	defer func() {
+		db.Close()
+		log.Info("database closed")
+	}()
 
 	// run simple migration on startup
 	if err := store.EnsureMigrations(db); err != nil {
-		log.Fatalf("failed to run migrations: %v", err)
+		return fmt.Errorf("failed to run migrations: %w", err)
 	}
 
 	repo := store.NewPostgresRepository(db, log)
-	h := handlers.NewHandler(repo, log)
+	if cfg.RatesFile != "" {
+		if err := loadRates(repo, cfg.RatesFile); err != nil {
+			return fmt.Errorf("failed to load exchange rates: %w", err)
+		}
+		log.Infof("loaded exchange rates from %s", cfg.RatesFile)
+	}
+	reg := newMetrics(db, repo)
+	calls := reg.NewHistogramVec("store_call_duration_seconds", "Repository call latency by method and result.", metrics.DefBuckets, "method", "result")
+	h := handlers.NewHandler(store.Instrument(repo, func(method string, d time.Duration, err error) {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		calls.WithLabelValues(method, result).Observe(d.Seconds())
+	}), log)
 
+	tracer, err := tracing.New(tracing.Options{
+		Endpoint:    cfg.Tracing.Endpoint,
+		ServiceName: cfg.Tracing.ServiceName,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	}, log)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	if cfg.Tracing.Endpoint != "" {
+		log.Infof("exporting traces to %s", cfg.Tracing.Endpoint)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+		defer cancel()
+		if err := tracer.Shutdown(ctx); err != nil {
+			log.Warnf("failed to flush traces: %v", err)
+		}
+	}()
+
+	var verifier *auth.Verifier
+	if cfg.Auth.JWT() {
+		verifier, err = auth.NewVerifier(auth.Options{
+			HS256Secret: cfg.Auth.HS256Secret,
+			JWKSFile:    cfg.Auth.JWKSFile,
+			Issuer:      cfg.Auth.Issuer,
+			Audience:    cfg.Auth.Audience,
+			AdminScope:  cfg.Auth.AdminScope,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to configure authentication: %w", err)
+		}
+	}
+	var keys auth.KeyStore
+	if cfg.Auth.APIKeys {
+		keys = repo
+	}
+	if !cfg.Auth.Enabled() {
+		log.Warn("authentication is disabled, set auth.hs256_secret, auth.jwks_file or auth.api_keys to enable it")
+	}
+
+	// handlers still running once the drain timeout is over are waited for,
+	// they may be using the database
+	var inflight sync.WaitGroup
 	r := chi.NewRouter()
 	// middlewares
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inflight.Add(1)
+			defer inflight.Done()
+			next.ServeHTTP(w, r)
+		})
+	})
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
+	r.Use(quiet(tracer.Middleware))
 	r.Use(middleware.Recoverer)
-	r.Use(loggingMiddleware(log))
-
-	r.Route("/subscriptions", func(r chi.Router) {
-		r.Post("/", h.Create)
-		r.Get("/", h.List)
-		r.Get("/{id}", h.Get)
-		r.Put("/{id}", h.Update)
-		r.Delete("/{id}", h.Delete)
-		r.Get("/aggregate", h.Aggregate)
+	r.Use(quiet(logging.Middleware(log)))
+	r.Use(reg.HTTPMiddleware())
+
+	// probes for the orchestrator, outside authentication and rate limits
+	checker := health.NewChecker(cfg.ReadyTimeout, log)
+	checker.Add("db", repo.Ping)
+	checker.Add("migrations", repo.CheckSchema)
+	r.Get("/healthz", health.Live)
+	r.Get("/readyz", checker.Ready)
+	r.Get("/version", health.Version)
+
+	// API routes, the docs stay public; API keys need the scope of the route
+	read := auth.RequireScope(model.ScopeRead)
+	write := auth.RequireScope(model.ScopeWrite)
+	aggregate := auth.RequireScope(model.ScopeAggregate)
+	admin := auth.RequireScope(model.ScopeAdmin)
+	// the spend queries are expensive and get a stricter per-client limit
+	heavy := func(next http.Handler) http.Handler { return next }
+	if cfg.RateLimit.AggregateRPS > 0 {
+		heavy = ratelimit.New(cfg.RateLimit.AggregateRPS, cfg.RateLimit.AggregateBurst).Middleware(clientKey)
+	}
+	r.Group(func(r chi.Router) {
+		r.Use(limitBody(cfg.Server.MaxBodyBytes))
+		if cfg.RateLimit.MaxConcurrent > 0 {
+			r.Use(ratelimit.NewShedder(cfg.RateLimit.MaxConcurrent).Middleware)
+		}
+		if cfg.Auth.Enabled() {
+			// failures are charged to the IP, as the caller is unknown, so that
+			// made-up credentials are throttled before they cost a lookup; only
+			// rejected credentials count, a failing key store answers 503
+			if cfg.RateLimit.AuthFailureRPS > 0 {
+				failures := ratelimit.New(cfg.RateLimit.AuthFailureRPS, cfg.RateLimit.AuthFailureBurst)
+				r.Use(failures.Penalize(clientKey, func(status int) bool { return status == http.StatusUnauthorized }))
+			}
+			r.Use(auth.Middleware(verifier, keys), logPrincipal)
+		}
+		// clients are limited after authentication so that they are told apart by key or user
+		if cfg.RateLimit.RPS > 0 {
+			r.Use(ratelimit.New(cfg.RateLimit.RPS, cfg.RateLimit.Burst).Middleware(clientKey))
+		}
+
+		r.Route("/subscriptions", func(r chi.Router) {
+			r.With(write).Post("/", h.Create)
+			r.With(read).Get("/", h.List)
+			r.With(read).Get("/{id}", h.Get)
+			r.With(write).Put("/{id}", h.Update)
+			r.With(write).Patch("/{id}", h.Patch)
+			r.With(write).Delete("/{id}", h.Delete)
+			r.With(read).Get("/{id}/pauses", h.Pauses)
+			r.With(read).Get("/{id}/prices", h.Prices)
+			r.With(write).Post("/{id}/pause", h.Pause)
+			r.With(write).Post("/{id}/resume", h.Resume)
+			r.With(read).Get("/{id}/members", h.Members)
+			r.With(write).Put("/{id}/members", h.SetMembers)
+			r.With(aggregate, heavy).Get("/aggregate", h.Aggregate)
+			r.With(aggregate, heavy).Get("/forecast", h.Forecast)
+			r.With(read).Get("/renewals", h.Renewals)
+			r.With(read).Get("/calendar.ics", h.Calendar)
+			r.With(write).Post("/calendar-token", h.CreateCalendarToken)
+			r.With(write).Delete("/calendar-token", h.RevokeCalendarToken)
+			r.With(aggregate, heavy).Get("/settlement", h.Settlement)
+		})
+
+		r.Route("/services", func(r chi.Router) {
+			r.With(read).Get("/", h.SearchServices)
+			r.With(admin).Post("/", h.CreateService)
+			r.With(admin).Post("/{id}/aliases", h.AddAliases)
+		})
+
+		r.Route("/budgets", func(r chi.Router) {
+			r.With(write).Post("/", h.CreateBudget)
+			r.With(read).Get("/", h.ListBudgets)
+			r.With(aggregate, heavy).Get("/report", h.BudgetReport)
+			r.With(write).Delete("/{id}", h.DeleteBudget)
+		})
+
+		r.Route("/api-keys", func(r chi.Router) {
+			r.Use(admin)
+			r.Post("/", h.CreateAPIKey)
+			r.Get("/", h.ListAPIKeys)
+			r.Delete("/{id}", h.RevokeAPIKey)
+			r.Post("/{id}/rotate", h.RotateAPIKey)
+		})
+
+		r.With(admin).Get("/log-level", h.GetLogLevel)
+		r.With(admin).Put("/log-level", h.SetLogLevel)
+	})
+
+	// calendar apps can't send credentials, the secret token of the feed URL
+	// authenticates them; the feed is outside authentication but rate limited
+	r.Group(func(r chi.Router) {
+		if cfg.RateLimit.RPS > 0 {
+			r.Use(ratelimit.New(cfg.RateLimit.RPS, cfg.RateLimit.Burst).Middleware(clientKey))
+		}
+		r.Get("/calendar.ics", h.CalendarFeed)
 	})
 
 	// serve swagger spec and UI
@@ -65,44 +249,212 @@ func main() {
 		http.ServeFile(w, r, "./docs/swagger-ui/index.html")
 	})
 
+	srv := &http.Server{
+		Addr:              cfg.Server.Address,
+		Handler:           r,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+	}
+	if cfg.Server.TLS.Enabled() {
+		certs, err := tlsconfig.New(tlsconfig.Options{
+			CertFile:           cfg.Server.TLS.CertFile,
+			KeyFile:            cfg.Server.TLS.KeyFile,
+			ClientCAFile:       cfg.Server.TLS.ClientCAFile,
+			ClientCertOptional: cfg.Server.TLS.ClientCertOptional,
+		}, log)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificates: %w", err)
+		}
+		srv.TLSConfig = certs.TLSConfig()
+		if cfg.Server.TLS.ClientCAFile != "" {
+			log.Info("serving HTTPS with client certificates")
+		} else {
+			log.Info("serving HTTPS")
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 2)
+	// the metrics show revenue, they are served apart from the API on an
+	// address that is only reachable by the scraper
+	metricsSrv := &http.Server{
+		Addr:              cfg.MetricsAddress,
+		Handler:           reg.Handler(),
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+	}
+	go func() {
+		if err := metricsSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- fmt.Errorf("metrics: %w", err)
+		}
+	}()
+	go func() {
+		if srv.TLSConfig != nil {
+			serveErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("server error: %w", err)
+	case <-ctx.Done():
+	}
+	// from now on a second signal terminates the process
+	stop()
+
+	log.Infof("shutting down, not ready for %s before draining requests", cfg.Shutdown.ReadyDelay)
+	checker.Drain()
+	time.Sleep(cfg.Shutdown.ReadyDelay)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.DrainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		log.Warnf("requests still running after %s are cancelled: %v", cfg.Shutdown.DrainTimeout, err)
+		// closing the connections cancels the contexts of the requests and so their queries
+		srv.Close()
+	}
+	inflight.Wait()
+	log.Info("requests drained")
+	// scraped until the end so that the drain shows in the metrics
+	metricsSrv.Close()
+	return nil
 }
 
-func loggingMiddleware(log *logrus.Logger) func(http.Handler) http.Handler {
+// paths that are neither logged nor traced: probes are polled every few
+// seconds and would drown the other lines
+var quietPaths = map[string]bool{"/healthz": true, "/readyz": true, "/version": true}
+
+// quiet skips mw for the quietPaths
+func quiet(mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if quietPaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitBody caps the request bodies of the API, handlers answer 413 beyond n bytes
+func limitBody(n int64) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			rid := middleware.GetReqID(r.Context())
-			start := time.Now()
+			r.Body = http.MaxBytesReader(w, r.Body, n)
 			next.ServeHTTP(w, r)
-			log.WithFields(logrus.Fields{
-				"req_id": rid,
-				"method": r.Method,
-				"path":   r.URL.Path,
-				"dur_ms": time.Since(start).Milliseconds(),
-			}).Info("handled request")
 		})
 	}
 }
 
-	srv := &http.Server{
-		Addr:    cfg.Server.Address,
-		Handler: r,
+// logPrincipal adds the caller to the log fields of the request
+func logPrincipal(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := auth.FromContext(r.Context()); ok {
+			if p.KeyID != nil {
+				logging.AddFields(r.Context(), logrus.Fields{"api_key": p.KeyID.String()})
+			} else {
+				logging.AddFields(r.Context(), logrus.Fields{"user": p.UserID.String()})
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey tells clients apart for rate limiting: by API key, user or IP,
+// which RealIP takes from the proxy headers
+func clientKey(r *http.Request) string {
+	if p, ok := auth.FromContext(r.Context()); ok {
+		if p.KeyID != nil {
+			return "key:" + p.KeyID.String()
+		}
+		return "user:" + p.UserID.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
 	}
+	return "ip:" + host
+}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("server error: %v", err)
+// newMetrics registers the database pool and business metrics, the latter are
+// computed at most once a minute however often /metrics is scraped
+func newMetrics(db *sqlx.DB, repo *store.PostgresRepo) *metrics.Registry {
+	reg := metrics.NewRegistry()
+	reg.DBStats(db.DB, "subscriptions")
+	active := metrics.Cached(time.Minute, func() (int, error) {
+		return repo.CountActive(time.Now().UTC())
+	})
+	reg.NewGaugeFunc("subscriptions_active", "Subscriptions running in the current month.", func() ([]metrics.Sample, error) {
+		n, err := active()
+		return []metrics.Sample{{Value: float64(n)}}, err
+	})
+	mrr := metrics.Cached(time.Minute, func() (revenue, error) {
+		return monthlyRevenue(repo, time.Now().UTC())
+	})
+	reg.NewGaugeFunc("subscriptions_mrr_rub", "Monthly recurring revenue of the current month in RUB, subscriptions in currencies without an exchange rate left out.", func() ([]metrics.Sample, error) {
+		v, err := mrr()
+		return []metrics.Sample{{Value: float64(v.converted) / 100}}, err
+	})
+	reg.NewGaugeFunc("subscriptions_mrr_unconverted", "Monthly recurring revenue of the current month left out of subscriptions_mrr_rub for lack of an exchange rate, in its own currency.", func() ([]metrics.Sample, error) {
+		v, err := mrr()
+		samples := make([]metrics.Sample, 0, len(v.unconverted))
+		for cur, amount := range v.unconverted {
+			samples = append(samples, metrics.Sample{Value: float64(amount) / 100, Labels: []string{cur}})
 		}
-	}()
+		return samples, err
+	}, "currency")
+	return reg
+}
+
+// revenue is the spend of a month in the base currency and, per currency, the
+// part of it that could not be converted
+type revenue struct {
+	converted   model.Money
+	unconverted map[string]model.Money
+}
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
-	log.Info("shutting down server")
+// monthlyRevenue computes the revenue of the month of at one currency at a
+// time, so that a currency without an exchange rate doesn't hide the others
+func monthlyRevenue(repo *store.PostgresRepo, at time.Time) (revenue, error) {
+	res := revenue{unconverted: map[string]model.Money{}}
+	month := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, time.UTC)
+	currencies, err := repo.ActiveCurrencies(month)
+	if err != nil {
+		return res, err
+	}
+	for _, cur := range currencies {
+		f := store.Filter{Currency: &cur}
+		totals, err := repo.ForecastSum(f, month, 1, model.BaseCurrency)
+		if errors.Is(err, store.ErrNoRate) {
+			if totals, err = repo.ForecastSum(f, month, 1, cur); err != nil {
+				return res, err
+			}
+			res.unconverted[cur] = totals[0]
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+		res.converted += totals[0]
+	}
+	return res, nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("server forced to shutdown: %v", err)
+func loadRates(repo *store.PostgresRepo, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
-	log.Info("server stopped")
+	defer f.Close()
+	rs, err := rates.ParseECB(f)
+	if err != nil {
+		return err
+	}
+	return repo.SaveRates(rs)
 }
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+)
+
+// API keys look like sk_<prefix>_<secret>, both parts hex
+const (
+	apiKeyTag    = "sk_"
+	prefixBytes  = 6
+	secretBytes  = 32
+	apiKeyHeader = "X-API-Key"
+)
+
+var ErrInvalidKey = errors.New("invalid API key")
+
+// ErrKeyLookup wraps the failures of the key store, which say nothing of the
+// key; they must not be mistaken for a wrong key
+var ErrKeyLookup = errors.New("API key lookup failed")
+
+// KeyStore looks up API keys by prefix and records their use
+type KeyStore interface {
+	FindAPIKey(prefix string) (*model.APIKey, error)
+	TouchAPIKey(id uuid.UUID, at time.Time) error
+}
+
+// NewAPIKey generates a key, returning it with the prefix it is looked up by
+// and the hash to store in place of the secret
+func NewAPIKey() (key, prefix string, hash []byte, err error) {
+	b := make([]byte, prefixBytes+secretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", nil, err
+	}
+	prefix = hex.EncodeToString(b[:prefixBytes])
+	key = apiKeyTag + prefix + "_" + hex.EncodeToString(b[prefixBytes:])
+	return key, prefix, HashAPIKey(key), nil
+}
+
+// HashAPIKey hashes a key for storage; keys are random, so a fast hash suffices
+func HashAPIKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// isAPIKey tells API keys from JWTs sent as bearer tokens
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyTag)
+}
+
+// authenticateKey checks key against the store and returns the caller it belongs to;
+// API keys are not tied to a user, what they may do is limited by their scopes
+func authenticateKey(keys KeyStore, key string, now time.Time) (*Principal, error) {
+	parts := strings.Split(strings.TrimPrefix(key, apiKeyTag), "_")
+	if len(parts) != 2 || len(parts[0]) != 2*prefixBytes {
+		return nil, ErrInvalidKey
+	}
+	k, err := keys.FindAPIKey(parts[0])
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %v", ErrKeyLookup, err)
+	}
+	if err != nil || k == nil || subtle.ConstantTimeCompare(k.Hash, HashAPIKey(key)) != 1 {
+		return nil, ErrInvalidKey
+	}
+	// last-used tracking is best effort and must not fail the request
+	_ = keys.TouchAPIKey(k.ID, now)
+	id := k.ID
+	p := &Principal{KeyID: &id, Scopes: k.Scopes, AllUsers: true}
+	p.Admin = p.HasScope(model.ScopeAdmin)
+	return p, nil
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+)
+
+type keyStore struct {
+	keys    map[string]*model.APIKey
+	touched []uuid.UUID
+	// returned by every lookup when set
+	err error
+}
+
+func (s *keyStore) FindAPIKey(prefix string) (*model.APIKey, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if k, ok := s.keys[prefix]; ok {
+		return k, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *keyStore) TouchAPIKey(id uuid.UUID, at time.Time) error {
+	s.touched = append(s.touched, id)
+	return nil
+}
+
+func TestNewAPIKey(t *testing.T) {
+	key, prefix, hash, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != len(apiKeyTag)+2*prefixBytes+1+2*secretBytes || !isAPIKey(key) || key[3:3+len(prefix)] != prefix {
+		t.Fatalf("unexpected key %q with prefix %q", key, prefix)
+	}
+	if string(hash) != string(HashAPIKey(key)) {
+		t.Fatal("hash does not match the key")
+	}
+	other, _, _, _ := NewAPIKey()
+	if other == key {
+		t.Fatal("keys must be random")
+	}
+}
+
+func TestMiddleware_APIKey(t *testing.T) {
+	key, prefix, hash, _ := NewAPIKey()
+	id := uuid.New()
+	store := &keyStore{keys: map[string]*model.APIKey{prefix: {ID: id, Prefix: prefix, Hash: hash, Scopes: []string{model.ScopeRead}}}}
+	var got *Principal
+	h := Middleware(nil, store)(RequireScope(model.ScopeRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = FromContext(r.Context())
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/", nil)
+	req.Header.Set("X-API-Key", key)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || got == nil || got.KeyID == nil || *got.KeyID != id || !got.AllUsers || got.Admin {
+		t.Fatalf("unexpected result: %d %+v", rr.Code, got)
+	}
+	if len(store.touched) != 1 || store.touched[0] != id {
+		t.Fatalf("expected the key use to be recorded, got %v", store.touched)
+	}
+
+	// a bearer token that is an API key works too
+	req = httptest.NewRequest(http.MethodGet, "/subscriptions/", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("bearer api key: expected 200, got %d", rr.Code)
+	}
+
+	wrong := key[:len(key)-1] + "0"
+	if wrong == key {
+		wrong = key[:len(key)-1] + "1"
+	}
+	for _, k := range []string{wrong, "sk_abc", "sk_" + prefix, "eyJhbGciOiJIUzI1NiJ9.e30.sig"} {
+		req := httptest.NewRequest(http.MethodGet, "/subscriptions/", nil)
+		req.Header.Set("X-API-Key", k)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("%q: expected 401, got %d", k, rr.Code)
+		}
+	}
+}
+
+func TestMiddleware_KeyStoreDown(t *testing.T) {
+	key, _, _, _ := NewAPIKey()
+	h := Middleware(nil, &keyStore{err: errors.New("connection refused")})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("request must not be served")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/", nil)
+	req.Header.Set("X-API-Key", key)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable || strings.Contains(rr.Body.String(), "connection refused") {
+		t.Fatalf("expected 503 without the cause, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	id := uuid.New()
+	h := RequireScope(model.ScopeWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		name string
+		p    *Principal
+		code int
+	}{
+		{"no auth", nil, http.StatusOK},
+		{"jwt user", &Principal{UserID: uuid.New()}, http.StatusOK},
+		{"read key", &Principal{KeyID: &id, Scopes: []string{model.ScopeRead}, AllUsers: true}, http.StatusForbidden},
+		{"write key", &Principal{KeyID: &id, Scopes: []string{model.ScopeRead, model.ScopeWrite}, AllUsers: true}, http.StatusOK},
+		{"admin key", &Principal{KeyID: &id, Scopes: []string{model.ScopeAdmin}, AllUsers: true, Admin: true}, http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/subscriptions/", nil)
+		if c.p != nil {
+			req = req.WithContext(WithPrincipal(req.Context(), c.p))
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != c.code {
+			t.Errorf("%s: expected %d, got %d", c.name, c.code, rr.Code)
+		}
+	}
+}
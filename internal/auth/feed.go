@@ -0,0 +1,25 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Calendar apps fetch the feed without headers, so its URL carries a random
+// token instead; like API keys it is stored hashed and can be revoked
+const feedTokenBytes = 32
+
+// NewFeedToken generates a calendar feed token, returning it with the hash to store
+func NewFeedToken() (token string, hash []byte, err error) {
+	b := make([]byte, feedTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token = hex.EncodeToString(b)
+	return token, HashFeedToken(token), nil
+}
+
+// HashFeedToken hashes a feed token for storage and lookup
+func HashFeedToken(token string) []byte {
+	return HashAPIKey(token)
+}
@@ -0,0 +1,258 @@
+// Package auth validates bearer JWTs and carries the authenticated caller in the request context.
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// leeway tolerates clock skew between the issuer and the service
+const leeway = 30 * time.Second
+
+var (
+	ErrMalformed    = errors.New("malformed token")
+	ErrAlgorithm    = errors.New("unsupported signing algorithm")
+	ErrUnknownKey   = errors.New("unknown signing key")
+	ErrSignature    = errors.New("invalid signature")
+	ErrExpired      = errors.New("token expired")
+	ErrNotYetValid  = errors.New("token not valid yet")
+	ErrIssuer       = errors.New("unexpected issuer")
+	ErrAudience     = errors.New("unexpected audience")
+	ErrInvalidClaim = errors.New("subject must be a user id")
+)
+
+// Options configure a Verifier, at least one of HS256Secret and JWKSFile is required
+type Options struct {
+	// HMAC key of HS256 tokens
+	HS256Secret string
+	// JSON Web Key Set with the RSA public keys of RS256 tokens
+	JWKSFile string
+	// expected iss and aud claims, not checked when empty
+	Issuer   string
+	Audience string
+	// scope granting access to the data of every user
+	AdminScope string
+}
+
+// Verifier checks the signature and claims of HS256 and RS256 tokens
+type Verifier struct {
+	secret     []byte
+	keys       map[string]*rsa.PublicKey
+	issuer     string
+	audience   string
+	adminScope string
+}
+
+// NewVerifier builds a Verifier, reading the JWKS file if one is configured
+func NewVerifier(o Options) (*Verifier, error) {
+	v := &Verifier{issuer: o.Issuer, audience: o.Audience, adminScope: o.AdminScope}
+	if o.HS256Secret != "" {
+		v.secret = []byte(o.HS256Secret)
+	}
+	if o.JWKSFile != "" {
+		f, err := os.Open(o.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if v.keys, err = parseJWKS(f); err != nil {
+			return nil, fmt.Errorf("jwks %s: %w", o.JWKSFile, err)
+		}
+	}
+	if v.secret == nil && len(v.keys) == 0 {
+		return nil, errors.New("no HS256 secret or RS256 keys configured")
+	}
+	if v.adminScope == "" {
+		v.adminScope = "admin"
+	}
+	return v, nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// claims are the registered claims the service reads plus the OAuth scope,
+// either a space separated scope string or an scp list
+type claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *int64   `json:"exp"`
+	NotBefore *int64   `json:"nbf"`
+	Scope     string   `json:"scope"`
+	Scp       []string `json:"scp"`
+}
+
+// audience accepts both forms of the aud claim, a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+// Verify validates a compact JWT at now and returns the caller it authenticates
+func (v *Verifier) Verify(token string, now time.Time) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch h.Alg {
+	case "HS256":
+		if v.secret == nil {
+			return nil, ErrAlgorithm
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, ErrSignature
+		}
+	case "RS256":
+		key, err := v.key(h.Kid)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+			return nil, ErrSignature
+		}
+	default:
+		// includes "none", the algorithm always comes from the verifier's keys
+		return nil, ErrAlgorithm
+	}
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, ErrMalformed
+	}
+	if c.ExpiresAt == nil || !now.Before(time.Unix(*c.ExpiresAt, 0).Add(leeway)) {
+		return nil, ErrExpired
+	}
+	if c.NotBefore != nil && now.Add(leeway).Before(time.Unix(*c.NotBefore, 0)) {
+		return nil, ErrNotYetValid
+	}
+	if v.issuer != "" && c.Issuer != v.issuer {
+		return nil, ErrIssuer
+	}
+	if v.audience != "" && !contains(c.Audience, v.audience) {
+		return nil, ErrAudience
+	}
+	uid, err := uuid.Parse(c.Subject)
+	if err != nil {
+		return nil, ErrInvalidClaim
+	}
+	scopes := append(strings.Fields(c.Scope), c.Scp...)
+	admin := contains(scopes, v.adminScope)
+	return &Principal{UserID: uid, Scopes: scopes, AllUsers: admin, Admin: admin}, nil
+}
+
+// key picks the RSA key named by kid, a token without kid is accepted only
+// when the key set holds a single key
+func (v *Verifier) key(kid string) (*rsa.PublicKey, error) {
+	if len(v.keys) == 0 {
+		return nil, ErrAlgorithm
+	}
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, nil
+		}
+	}
+	k, ok := v.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return k, nil
+}
+
+func decodeSegment(s string, dst interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseJWKS reads the RSA signing keys of a JSON Web Key Set keyed by kid,
+// keys of other types or uses are skipped
+func parseJWKS(r io.Reader) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for i, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != "RS256") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil || len(n) == 0 {
+			return nil, fmt.Errorf("key %d: invalid modulus", i)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("key %d: invalid exponent", i)
+		}
+		exp := 0
+		for _, b := range e {
+			exp = exp<<8 | int(b)
+		}
+		if _, dup := keys[k.Kid]; dup {
+			return nil, fmt.Errorf("key %d: duplicate kid %q", i, k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA signing keys")
+	}
+	return keys, nil
+}
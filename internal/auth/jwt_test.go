@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var now = time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+
+func segment(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hs256(t *testing.T, secret string, claims map[string]interface{}) string {
+	signed := segment(t, map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + segment(t, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signed := segment(t, map[string]string{"alg": "RS256", "kid": kid}) + "." + segment(t, claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerify_HS256(t *testing.T) {
+	v, err := NewVerifier(Options{HS256Secret: "secret", Issuer: "idp", Audience: "subscriptions"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := uuid.New()
+	claims := map[string]interface{}{
+		"sub": uid.String(), "iss": "idp", "aud": []string{"billing", "subscriptions"},
+		"exp": now.Add(time.Hour).Unix(), "scope": "read admin",
+	}
+	p, err := v.Verify(hs256(t, "secret", claims), now)
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if p.UserID != uid || !p.Admin {
+		t.Fatalf("unexpected principal: %+v", p)
+	}
+
+	claims["scope"] = "read"
+	if p, err = v.Verify(hs256(t, "secret", claims), now); err != nil || p.Admin {
+		t.Fatalf("expected a non-admin principal, got %+v, %v", p, err)
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"wrong secret", hs256(t, "other", claims), ErrSignature},
+		{"expired", hs256(t, "secret", with(claims, "exp", now.Add(-time.Hour).Unix())), ErrExpired},
+		{"no exp", hs256(t, "secret", with(claims, "exp", nil)), ErrExpired},
+		{"not yet valid", hs256(t, "secret", with(claims, "nbf", now.Add(time.Hour).Unix())), ErrNotYetValid},
+		{"issuer", hs256(t, "secret", with(claims, "iss", "evil")), ErrIssuer},
+		{"audience", hs256(t, "secret", with(claims, "aud", "billing")), ErrAudience},
+		{"subject", hs256(t, "secret", with(claims, "sub", "alice")), ErrInvalidClaim},
+		{"alg none", segment(t, map[string]string{"alg": "none"}) + "." + segment(t, claims) + ".", ErrAlgorithm},
+		{"malformed", "abc.def", ErrMalformed},
+	}
+	for _, c := range cases {
+		if _, err := v.Verify(c.token, now); !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func with(claims map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	for k, v := range claims {
+		res[k] = v
+	}
+	if value == nil {
+		delete(res, key)
+	} else {
+		res[key] = value
+	}
+	return res
+}
+
+func TestVerify_RS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec", "crv": "P-256"},
+		{
+			"kty": "RSA", "kid": "k1", "use": "sig", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		},
+	}}
+	b, _ := json.Marshal(jwks)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVerifier(Options{JWKSFile: path, AdminScope: "subscriptions:admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := uuid.New()
+	claims := map[string]interface{}{"sub": uid.String(), "exp": now.Add(time.Minute).Unix(), "scp": []string{"subscriptions:admin"}}
+	p, err := v.Verify(rs256(t, key, "k1", claims), now)
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if p.UserID != uid || !p.Admin {
+		t.Fatalf("unexpected principal: %+v", p)
+	}
+	// the only key is used when the token names none
+	if _, err := v.Verify(rs256(t, key, "", claims), now); err != nil {
+		t.Fatalf("verify without kid failed: %v", err)
+	}
+	if _, err := v.Verify(rs256(t, key, "k2", claims), now); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected unknown key, got %v", err)
+	}
+	// HS256 is not accepted without a secret, even signed with the public modulus
+	if _, err := v.Verify(hs256(t, jwks["keys"].([]map[string]string)[1]["n"], claims), now); !errors.Is(err, ErrAlgorithm) {
+		t.Fatalf("expected unsupported algorithm, got %v", err)
+	}
+}
+
+func TestNewVerifier_NoKeys(t *testing.T) {
+	if _, err := NewVerifier(Options{}); err == nil {
+		t.Fatal("expected an error without keys")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	v, _ := NewVerifier(Options{HS256Secret: "secret"})
+	uid := uuid.New()
+	var got *Principal
+	h := Middleware(v, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = FromContext(r.Context())
+	}))
+
+	for _, header := range []string{"", "Basic abc", "Bearer abc.def.ghi"} {
+		req := httptest.NewRequest(http.MethodGet, "/subscriptions/", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("%q: expected 401 with a challenge, got %d", header, rr.Code)
+		}
+	}
+
+	token := hs256(t, "secret", map[string]interface{}{"sub": uid.String(), "exp": time.Now().Add(time.Hour).Unix()})
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || got == nil || got.UserID != uid || got.Admin {
+		t.Fatalf("unexpected result: %d %+v", rr.Code, got)
+	}
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/logging"
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/effectivemobile/subscriptions/internal/tracing"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID uuid.UUID
+	// set for API keys, which act for no user
+	KeyID  *uuid.UUID
+	Scopes []string
+	// callers that see and modify the data of every user; API keys always do,
+	// they are restricted by scopes instead
+	AllUsers bool
+	// callers that manage the service catalog, API keys and the log level:
+	// users with the admin scope of the verifier and keys with model.ScopeAdmin
+	Admin bool
+}
+
+// HasScope reports whether the caller was granted scope, admin implies every scope
+func (p *Principal) HasScope(scope string) bool {
+	return contains(p.Scopes, scope) || contains(p.Scopes, model.ScopeAdmin)
+}
+
+type ctxKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, ctxKey{}, p)
+}
+
+// FromContext returns the caller of the request, false when authentication is disabled
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(ctxKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// Middleware rejects requests without valid credentials with 401 and stores
+// the caller of the others in the request context. Credentials are an API key
+// in X-API-Key or a bearer token, which is either an API key or a JWT; v or
+// keys may be nil to not accept JWTs or API keys. Requests whose API key could
+// not be looked up get 503, their credentials may well be valid.
+func Middleware(v *Verifier, keys KeyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get(apiKeyHeader)
+			if token == "" {
+				token, _ = bearer(r)
+			}
+			var (
+				p   *Principal
+				err error
+			)
+			switch {
+			case token == "":
+				unauthorized(w, r, "missing credentials")
+				return
+			case isAPIKey(token) && keys != nil:
+				p, err = authenticateKey(keys, token, time.Now())
+			case !isAPIKey(token) && v != nil:
+				p, err = v.Verify(token, time.Now())
+			default:
+				unauthorized(w, r, "unsupported credentials")
+				return
+			}
+			if errors.Is(err, ErrKeyLookup) {
+				unavailable(w, r, err)
+				return
+			}
+			if err != nil {
+				unauthorized(w, r, err.Error())
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+		})
+	}
+}
+
+// RequireScope rejects API keys without scope with 403; JWT callers pass, the
+// handlers restrict them to their own data
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p, ok := FromContext(r.Context()); ok && p.KeyID != nil && !p.HasScope(scope) {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(tracing.ErrorBody(r.Context(), "API key lacks the "+scope+" scope"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func bearer(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(h[7:])
+	return token, token != ""
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(tracing.ErrorBody(r.Context(), msg))
+}
+
+func unavailable(w http.ResponseWriter, r *http.Request, err error) {
+	l, ok := logging.FromContext(r.Context())
+	if !ok {
+		l = logrus.WithContext(r.Context())
+	}
+	l.Errorf("authentication failed: %v", err)
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(tracing.ErrorBody(r.Context(), "credentials could not be checked, retry later"))
+}
@@ -9,6 +9,31 @@ import (
 
 type ServerConfig struct {
 	Address string `mapstructure:"address"`
+	// bounds of reading a whole request, its headers, writing the response and
+	// keeping an idle connection open
+	ReadTimeout       time.Duration `mapstructure:"read_timeout"`
+	ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+	WriteTimeout      time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout       time.Duration `mapstructure:"idle_timeout"`
+	MaxHeaderBytes    int           `mapstructure:"max_header_bytes"`
+	// limit of JSON request bodies, larger ones get 413
+	MaxBodyBytes int64     `mapstructure:"max_body_bytes"`
+	TLS          TLSConfig `mapstructure:"tls"`
+}
+
+// TLSConfig serves HTTPS when a certificate is set, the files are reloaded
+// when they change
+type TLSConfig struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// CAs of client certificates, requires them (mutual TLS) when set
+	ClientCAFile string `mapstructure:"client_ca_file"`
+	// let clients without a certificate in, such as the probes of the orchestrator
+	ClientCertOptional bool `mapstructure:"client_cert_optional"`
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != ""
 }
 
 type PostgresConfig struct {
@@ -24,10 +49,89 @@ func (p PostgresConfig) DSN() string {
 		p.Host, p.Port, p.User, p.Password, p.DBName)
 }
 
+// AuthConfig configures authentication with bearer JWTs and API keys, which
+// is disabled when neither is configured
+type AuthConfig struct {
+	HS256Secret string `mapstructure:"hs256_secret"`
+	// JSON Web Key Set with the RSA public keys of RS256 tokens
+	JWKSFile string `mapstructure:"jwks_file"`
+	// expected iss and aud claims, not checked when empty
+	Issuer   string `mapstructure:"issuer"`
+	Audience string `mapstructure:"audience"`
+	// scope that grants access to every user's data
+	AdminScope string `mapstructure:"admin_scope"`
+	// accept the API keys stored in the database
+	APIKeys bool `mapstructure:"api_keys"`
+}
+
+// JWT reports whether bearer JWTs are accepted
+func (a AuthConfig) JWT() bool {
+	return a.HS256Secret != "" || a.JWKSFile != ""
+}
+
+// Enabled reports whether requests must carry credentials
+func (a AuthConfig) Enabled() bool {
+	return a.JWT() || a.APIKeys
+}
+
+// RateLimitConfig throttles clients, a zero rate or cap disables that limit
+type RateLimitConfig struct {
+	// requests per second and burst of each client, told apart by API key, user or IP
+	RPS   float64 `mapstructure:"rps"`
+	Burst int     `mapstructure:"burst"`
+	// stricter limit of the expensive aggregate, forecast, settlement and budget report
+	AggregateRPS   float64 `mapstructure:"aggregate_rps"`
+	AggregateBurst int     `mapstructure:"aggregate_burst"`
+	// requests served at once, the rest are shed with 503
+	MaxConcurrent int `mapstructure:"max_concurrent"`
+	// failed authentications per second and burst of each IP, beyond them the
+	// IP gets 429 before its credentials are checked
+	AuthFailureRPS   float64 `mapstructure:"auth_failure_rps"`
+	AuthFailureBurst int     `mapstructure:"auth_failure_burst"`
+}
+
+// TracingConfig exports spans to an OpenTelemetry collector over OTLP/HTTP,
+// nothing is exported without an endpoint
+type TracingConfig struct {
+	// base URL of the collector, e.g. http://otel-collector:4318
+	Endpoint    string `mapstructure:"endpoint"`
+	ServiceName string `mapstructure:"service_name"`
+	// share of the traces started here that are exported, from 0 to 1
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// LogConfig sets up the service log, the level can be changed at runtime
+type LogConfig struct {
+	// trace, debug, info, warn or error
+	Level string `mapstructure:"level"`
+	// text or json
+	Format string `mapstructure:"format"`
+}
+
+// ShutdownConfig paces the shutdown on SIGTERM or SIGINT
+type ShutdownConfig struct {
+	// how long /readyz fails before the server stops accepting connections,
+	// enough for load balancers to take the instance out of rotation
+	ReadyDelay time.Duration `mapstructure:"ready_delay"`
+	// how long in-flight requests may take to finish, they are cancelled after
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+}
+
 type Config struct {
 	Server   ServerConfig   `mapstructure:"server"`
 	Postgres PostgresConfig `mapstructure:"postgres"`
 	Timeout  time.Duration  `mapstructure:"timeout"`
+	// ECB-style CSV with exchange rates loaded on startup (optional)
+	RatesFile string          `mapstructure:"rates_file"`
+	Auth      AuthConfig      `mapstructure:"auth"`
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+	// bound of the readiness checks of /readyz
+	ReadyTimeout time.Duration `mapstructure:"ready_timeout"`
+	Tracing      TracingConfig `mapstructure:"tracing"`
+	// listener of /metrics, kept off the API as the metrics show revenue
+	MetricsAddress string         `mapstructure:"metrics_address"`
+	Log            LogConfig      `mapstructure:"log"`
+	Shutdown       ShutdownConfig `mapstructure:"shutdown"`
 }
 
 func LoadConfig() (*Config, error) {
@@ -36,6 +140,7 @@ func LoadConfig() (*Config, error) {
 	v.SetConfigType("yaml")
 	v.AddConfigPath(".")
 	v.AutomaticEnv()
+	v.SetDefault("tracing.sample_ratio", 1.0)
 
 	if err := v.ReadInConfig(); err != nil {
 		// continue if not found
@@ -48,8 +153,44 @@ func LoadConfig() (*Config, error) {
 	if cfg.Server.Address == "" {
 		cfg.Server.Address = ":8080"
 	}
+	if cfg.Server.ReadTimeout == 0 {
+		cfg.Server.ReadTimeout = 15 * time.Second
+	}
+	if cfg.Server.ReadHeaderTimeout == 0 {
+		cfg.Server.ReadHeaderTimeout = 5 * time.Second
+	}
+	if cfg.Server.WriteTimeout == 0 {
+		cfg.Server.WriteTimeout = 30 * time.Second
+	}
+	if cfg.Server.IdleTimeout == 0 {
+		cfg.Server.IdleTimeout = 2 * time.Minute
+	}
+	if cfg.Server.MaxHeaderBytes == 0 {
+		cfg.Server.MaxHeaderBytes = 64 << 10
+	}
+	if cfg.Server.MaxBodyBytes == 0 {
+		cfg.Server.MaxBodyBytes = 1 << 20
+	}
+	if cfg.Server.TLS.ClientCAFile != "" && !cfg.Server.TLS.Enabled() {
+		return nil, fmt.Errorf("server.tls.client_ca_file requires server.tls.cert_file")
+	}
 	if cfg.Timeout == 0 {
 		cfg.Timeout = 5 * time.Second
 	}
+	if cfg.ReadyTimeout == 0 {
+		cfg.ReadyTimeout = 2 * time.Second
+	}
+	if cfg.Shutdown.DrainTimeout == 0 {
+		cfg.Shutdown.DrainTimeout = 15 * time.Second
+	}
+	if cfg.MetricsAddress == "" {
+		cfg.MetricsAddress = ":9090"
+	}
+	if cfg.Tracing.ServiceName == "" {
+		cfg.Tracing.ServiceName = "subscriptions"
+	}
+	if cfg.Auth.AdminScope == "" {
+		cfg.Auth.AdminScope = "admin"
+	}
 	return &cfg, nil
 }
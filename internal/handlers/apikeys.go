@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/effectivemobile/subscriptions/internal/auth"
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// CreateAPIKey issues a key for a back-office service, the secret is only in this response
+func (h *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	var req model.APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.invalidBody(w, r, err)
+		return
+	}
+	if err := h.val.Struct(&req); err != nil {
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	key, prefix, hash, err := auth.NewAPIKey()
+	if err != nil {
+		h.logger(r).Errorf("generate api key failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to create")
+		return
+	}
+	k := &model.APIKey{Name: req.Name, Prefix: prefix, Hash: hash, Scopes: uniqueScopes(req.Scopes)}
+	if err := h.repoFor(r).CreateAPIKey(k); err != nil {
+		h.logger(r).Errorf("create api key failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to create")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(model.APIKeyResponse{APIKey: k, Key: key})
+}
+
+func (h *Handler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	res, err := h.repoFor(r).ListAPIKeys()
+	if err != nil {
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
+		return
+	}
+	if err := h.repoFor(r).RevokeAPIKey(id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			h.writeError(w, r, http.StatusNotFound, "not found")
+			return
+		}
+		h.writeError(w, r, http.StatusInternalServerError, "failed to revoke")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RotateAPIKey replaces the secret of a key, the old one stops working at once
+func (h *Handler) RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
+		return
+	}
+	key, prefix, hash, err := auth.NewAPIKey()
+	if err != nil {
+		h.logger(r).Errorf("generate api key failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to rotate")
+		return
+	}
+	k, err := h.repoFor(r).RotateAPIKey(id, prefix, hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			h.writeError(w, r, http.StatusNotFound, "not found")
+			return
+		}
+		h.logger(r).Errorf("rotate api key failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to rotate")
+		return
+	}
+	json.NewEncoder(w).Encode(model.APIKeyResponse{APIKey: k, Key: key})
+}
+
+// uniqueScopes drops repeated scopes keeping the order
+func uniqueScopes(scopes []string) []string {
+	res := make([]string, 0, len(scopes))
+	seen := map[string]bool{}
+	for _, s := range scopes {
+		if !seen[s] {
+			seen[s] = true
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/effectivemobile/subscriptions/internal/auth"
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCreateAPIKeyHandler(t *testing.T) {
+	var stored *model.APIKey
+	mr := &mockRepo{}
+	mr.keyFn = func(k *model.APIKey) error {
+		stored = k
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	body := `{"name":"billing","scopes":["read","aggregate","read"]}`
+	rr := httptest.NewRecorder()
+	h.CreateAPIKey(rr, httptest.NewRequest(http.MethodPost, "/api-keys/", strings.NewReader(body)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var res struct {
+		Key    string   `json:"key"`
+		Prefix string   `json:"prefix"`
+		Scopes []string `json:"scopes"`
+		Hash   []byte   `json:"hash"`
+	}
+	readBody(t, rr.Body, &res)
+	if stored == nil || !strings.Contains(res.Key, stored.Prefix) || string(stored.Hash) != string(auth.HashAPIKey(res.Key)) {
+		t.Fatalf("unexpected key %q stored as %+v", res.Key, stored)
+	}
+	if len(res.Scopes) != 2 || res.Hash != nil {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+
+	rr = httptest.NewRecorder()
+	h.CreateAPIKey(rr, httptest.NewRequest(http.MethodPost, "/api-keys/", strings.NewReader(`{"name":"x","scopes":["delete"]}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("unknown scope: expected 400, got %d", rr.Code)
+	}
+
+	// user tokens need the admin scope
+	rr = httptest.NewRecorder()
+	h.CreateAPIKey(rr, asUser(httptest.NewRequest(http.MethodPost, "/api-keys/", strings.NewReader(body)), uuid.New(), false))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("non-admin: expected 403, got %d", rr.Code)
+	}
+
+	// keys see every user's data but need the admin scope as well
+	keyID := uuid.New()
+	key := &auth.Principal{KeyID: &keyID, Scopes: []string{model.ScopeRead}, AllUsers: true}
+	rr = httptest.NewRecorder()
+	h.CreateAPIKey(rr, httptest.NewRequest(http.MethodPost, "/api-keys/", strings.NewReader(body)).WithContext(auth.WithPrincipal(context.Background(), key)))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("read key: expected 403, got %d", rr.Code)
+	}
+}
+
+func TestRevokeAPIKeyHandler_NotFound(t *testing.T) {
+	mr := &mockRepo{}
+	mr.revokeFn = func(uuid.UUID) error { return sql.ErrNoRows }
+	h := NewHandler(mr, logrus.New())
+
+	id := uuid.NewString()
+	rr := httptest.NewRecorder()
+	h.RevokeAPIKey(rr, withURLParam(httptest.NewRequest(http.MethodDelete, "/api-keys/"+id, nil), "id", id))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rr.Code)
+	}
+}
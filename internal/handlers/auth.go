@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/effectivemobile/subscriptions/internal/auth"
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+)
+
+// scopeUser restricts a user filter to the caller: a non-admin caller only
+// sees their own data, so a missing user id becomes theirs and another user's
+// is refused with a 403. Without authentication the filter is kept as is.
+func (h *Handler) scopeUser(w http.ResponseWriter, r *http.Request, uid *uuid.UUID) (*uuid.UUID, bool) {
+	p, ok := auth.FromContext(r.Context())
+	if !ok || p.AllUsers {
+		return uid, true
+	}
+	if uid != nil && *uid != p.UserID {
+		h.writeError(w, r, http.StatusForbidden, "access to another user's data is forbidden")
+		return nil, false
+	}
+	id := p.UserID
+	return &id, true
+}
+
+// canAccess reports whether the caller may read and modify sub
+func canAccess(r *http.Request, sub *model.Subscription) bool {
+	p, ok := auth.FromContext(r.Context())
+	return !ok || p.AllUsers || sub.UserID == p.UserID
+}
+
+// ownSubscription loads a subscription the caller may access, writing a 404
+// otherwise so that other users' subscriptions are indistinguishable from missing ones
+func (h *Handler) ownSubscription(w http.ResponseWriter, r *http.Request, id uuid.UUID) (*model.Subscription, bool) {
+	sub, err := h.repoFor(r).Get(id)
+	if err != nil {
+		h.lookupFailed(w, r, err)
+		return nil, false
+	}
+	if sub != nil && !canAccess(r, sub) {
+		h.writeError(w, r, http.StatusNotFound, "not found")
+		return nil, false
+	}
+	return sub, true
+}
+
+// lookupFailed answers a failed subscription lookup: 404 when there is no such
+// subscription, 500 when the store failed
+func (h *Handler) lookupFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		h.writeError(w, r, http.StatusNotFound, "not found")
+		return
+	}
+	h.logger(r).Errorf("get subscription failed: %v", err)
+	h.writeError(w, r, http.StatusInternalServerError, "failed to get the subscription")
+}
+
+// readSubscription is ownSubscription that also lets members of a shared
+// subscription read it
+func (h *Handler) readSubscription(w http.ResponseWriter, r *http.Request, id uuid.UUID) (*model.Subscription, bool) {
+	sub, err := h.repoFor(r).Get(id)
+	if err != nil {
+		h.lookupFailed(w, r, err)
+		return nil, false
+	}
+	if sub == nil || canAccess(r, sub) {
+		return sub, true
+	}
+	p, _ := auth.FromContext(r.Context())
+	members, err := h.repoFor(r).ListMembers(id)
+	if err != nil {
+		h.logger(r).Errorf("list members failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return nil, false
+	}
+	for _, m := range members {
+		if m.UserID == p.UserID {
+			return sub, true
+		}
+	}
+	h.writeError(w, r, http.StatusNotFound, "not found")
+	return nil, false
+}
+
+// checkSubscription is ownSubscription for handlers that only act on the id,
+// it skips the lookup when authentication is disabled
+func (h *Handler) checkSubscription(w http.ResponseWriter, r *http.Request, id uuid.UUID) bool {
+	if _, ok := auth.FromContext(r.Context()); !ok {
+		return true
+	}
+	_, ok := h.ownSubscription(w, r, id)
+	return ok
+}
+
+// requireAdmin writes a 403 unless the caller has the admin scope or authentication is disabled
+func (h *Handler) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if p, ok := auth.FromContext(r.Context()); ok && !p.Admin {
+		h.writeError(w, r, http.StatusForbidden, "admin scope required")
+		return false
+	}
+	return true
+}
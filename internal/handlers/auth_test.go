@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/auth"
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/effectivemobile/subscriptions/internal/store"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+func asUser(req *http.Request, uid uuid.UUID, admin bool) *http.Request {
+	return req.WithContext(auth.WithPrincipal(req.Context(), &auth.Principal{UserID: uid, AllUsers: admin, Admin: admin}))
+}
+
+func TestListHandler_ScopedToCaller(t *testing.T) {
+	uid, other := uuid.New(), uuid.New()
+	var got store.Filter
+	mr := &mockRepo{}
+	mr.listFn = func(f store.Filter) ([]model.Subscription, error) {
+		got = f
+		return nil, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	rr := httptest.NewRecorder()
+	h.List(rr, asUser(httptest.NewRequest(http.MethodGet, "/subscriptions/", nil), uid, false))
+	if rr.Code != http.StatusOK || got.UserID == nil || *got.UserID != uid {
+		t.Fatalf("expected the list scoped to the caller, got %d %+v", rr.Code, got.UserID)
+	}
+
+	for _, target := range []string{"/subscriptions/?user_id=" + other.String(), "/subscriptions/?q=user:" + other.String()} {
+		rr = httptest.NewRecorder()
+		h.List(rr, asUser(httptest.NewRequest(http.MethodGet, target, nil), uid, false))
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("%s: expected 403, got %d", target, rr.Code)
+		}
+	}
+
+	// admins see everything
+	got = store.Filter{}
+	rr = httptest.NewRecorder()
+	h.List(rr, asUser(httptest.NewRequest(http.MethodGet, "/subscriptions/", nil), uid, true))
+	if rr.Code != http.StatusOK || got.UserID != nil {
+		t.Fatalf("expected an unscoped list for an admin, got %d %+v", rr.Code, got.UserID)
+	}
+}
+
+func TestAggregateHandler_ScopedToCaller(t *testing.T) {
+	uid := uuid.New()
+	mr := &mockRepo{}
+	mr.aggregateFn = func(f store.Filter, from, to time.Time, currency string) (model.Money, error) {
+		if f.UserID == nil || *f.UserID != uid {
+			t.Fatalf("expected aggregation scoped to the caller, got %v", f.UserID)
+		}
+		return 100, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	rr := httptest.NewRecorder()
+	h.Aggregate(rr, asUser(httptest.NewRequest(http.MethodGet, "/subscriptions/aggregate?from=01-2025&to=02-2025", nil), uid, false))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+}
+
+func TestGetUpdateDeleteHandlers_OtherUser(t *testing.T) {
+	owner, caller := uuid.New(), uuid.New()
+	id := uuid.New()
+	mr := &mockRepo{}
+	mr.getFn = func(uuid.UUID) (*model.Subscription, error) {
+		return &model.Subscription{ID: id, UserID: owner, ServiceName: "Netflix"}, nil
+	}
+	mr.updateFn = func(*model.Subscription, time.Time) error {
+		t.Fatal("update of another user's subscription")
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	rr := httptest.NewRecorder()
+	h.Get(rr, asUser(withURLParam(httptest.NewRequest(http.MethodGet, "/subscriptions/"+id.String(), nil), "id", id.String()), caller, false))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("get: expected 404, got %d", rr.Code)
+	}
+
+	body := `{"service_name":"Netflix","price":100,"user_id":"` + caller.String() + `","start_date":"01-2025"}`
+	rr = httptest.NewRecorder()
+	h.Update(rr, asUser(withURLParam(httptest.NewRequest(http.MethodPut, "/subscriptions/"+id.String(), strings.NewReader(body)), "id", id.String()), caller, false))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("update: expected 404, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	h.Delete(rr, asUser(withURLParam(httptest.NewRequest(http.MethodDelete, "/subscriptions/"+id.String(), nil), "id", id.String()), caller, false))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("delete: expected 404, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	h.Get(rr, asUser(withURLParam(httptest.NewRequest(http.MethodGet, "/subscriptions/"+id.String(), nil), "id", id.String()), owner, false))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("get by owner: expected 200, got %d", rr.Code)
+	}
+}
+
+func TestCreateHandler_OtherUser(t *testing.T) {
+	h := NewHandler(&mockRepo{}, logrus.New())
+	body := `{"service_name":"Netflix","price":100,"user_id":"` + uuid.NewString() + `","start_date":"01-2025"}`
+
+	rr := httptest.NewRecorder()
+	h.Create(rr, asUser(httptest.NewRequest(http.MethodPost, "/subscriptions/", strings.NewReader(body)), uuid.New(), false))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rr.Code)
+	}
+}
+
+func TestSubscriptionLookup_StoreError(t *testing.T) {
+	uid, id := uuid.New(), uuid.New()
+	mr := &mockRepo{}
+	mr.getFn = func(uuid.UUID) (*model.Subscription, error) {
+		return nil, errors.New("connection refused")
+	}
+	h := NewHandler(mr, logrus.New())
+
+	// a failing store is not reported as a missing subscription
+	rr := httptest.NewRecorder()
+	h.Get(rr, asUser(withURLParam(httptest.NewRequest(http.MethodGet, "/subscriptions/"+id.String(), nil), "id", id.String()), uid, false))
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("get: expected 500, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	h.Patch(rr, asUser(withURLParam(httptest.NewRequest(http.MethodPatch, "/subscriptions/"+id.String(), strings.NewReader(`{"price":100}`)), "id", id.String()), uid, false))
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("patch: expected 500, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	h.Delete(rr, asUser(withURLParam(httptest.NewRequest(http.MethodDelete, "/subscriptions/"+id.String(), nil), "id", id.String()), uid, false))
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("delete: expected 500, got %d", rr.Code)
+	}
+}
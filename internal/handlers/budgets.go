@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/auth"
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/effectivemobile/subscriptions/internal/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+func (h *Handler) CreateBudget(w http.ResponseWriter, r *http.Request) {
+	var req model.BudgetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.invalidBody(w, r, err)
+		return
+	}
+	req.Currency = currencyCode(req.Currency)
+	if err := h.val.Struct(&req); err != nil {
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Category != nil && req.ServiceName != nil {
+		h.writeError(w, r, http.StatusBadRequest, "a budget is either for a category or for a service")
+		return
+	}
+	b := &model.Budget{
+		UserID:      uuid.MustParse(req.UserID),
+		ServiceName: req.ServiceName,
+		Amount:      req.Amount,
+		Currency:    req.Currency,
+	}
+	if _, ok := h.scopeUser(w, r, &b.UserID); !ok {
+		return
+	}
+	// categories are tags, which are stored lower case
+	if req.Category != nil {
+		c := strings.ToLower(strings.TrimSpace(*req.Category))
+		b.Category = &c
+	}
+	if err := h.repoFor(r).CreateBudget(b); err != nil {
+		if errors.Is(err, store.ErrBudgetExists) {
+			h.writeError(w, r, http.StatusConflict, err.Error())
+			return
+		}
+		h.logger(r).Errorf("create budget failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to create")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(b)
+}
+
+func (h *Handler) ListBudgets(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.URL.Query().Get("user_id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "user_id is required")
+		return
+	}
+	if _, ok := h.scopeUser(w, r, &uid); !ok {
+		return
+	}
+	res, err := h.repoFor(r).ListBudgets(uid)
+	if err != nil {
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) DeleteBudget(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
+		return
+	}
+	if !h.checkBudget(w, r, id) {
+		return
+	}
+	if err := h.repoFor(r).DeleteBudget(id); err != nil {
+		h.writeError(w, r, http.StatusInternalServerError, "failed to delete")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BudgetReport compares the actual spend of a user with each of their budgets per month
+func (h *Handler) BudgetReport(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.URL.Query().Get("user_id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "user_id is required")
+		return
+	}
+	if _, ok := h.scopeUser(w, r, &uid); !ok {
+		return
+	}
+	fromStr := r.URL.Query().Get("from")
+	toStr := r.URL.Query().Get("to")
+	if fromStr == "" || toStr == "" {
+		h.writeError(w, r, http.StatusBadRequest, "from and to are required in MM-YYYY format")
+		return
+	}
+	from, err := parseMonthYear(fromStr)
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid from format")
+		return
+	}
+	to, err := parseMonthYear(toStr)
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid to format")
+		return
+	}
+	if to.Before(from) || to.After(from.AddDate(0, maxForecastMonths-1, 0)) {
+		h.writeError(w, r, http.StatusBadRequest, "to must be within 36 months after from")
+		return
+	}
+	budgets, err := h.repoFor(r).ListBudgets(uid)
+	if err != nil {
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return
+	}
+	months := (to.Year()-from.Year())*12 + int(to.Month()-from.Month()) + 1
+	res := []model.BudgetMonth{}
+	for _, b := range budgets {
+		// one query per budget, it returns the spend of every month
+		spent, err := h.repoFor(r).ForecastSum(budgetFilter(b), from, months, b.Currency)
+		if err != nil {
+			if errors.Is(err, store.ErrNoRate) {
+				h.writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			h.logger(r).Errorf("budget report failed: %v", err)
+			h.writeError(w, r, http.StatusInternalServerError, "budget report failed")
+			return
+		}
+		for i, s := range spent {
+			month := from.AddDate(0, i, 0)
+			res = append(res, model.BudgetMonth{Budget: b, Month: month.Format(monthYearLayout), Spent: s, Over: s > b.Amount})
+		}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// budgetFilter selects the subscriptions a budget covers
+func budgetFilter(b model.Budget) store.Filter {
+	f := store.Filter{UserID: &b.UserID, ServiceName: b.ServiceName}
+	if b.Category != nil {
+		f.Tags = []string{*b.Category}
+	}
+	return f
+}
+
+// budgetMonth aggregates the spend a budget covers in a month
+func (h *Handler) budgetMonth(r *http.Request, b model.Budget, month time.Time) (model.BudgetMonth, error) {
+	res := model.BudgetMonth{Budget: b, Month: month.Format(monthYearLayout)}
+	spent, err := h.repoFor(r).AggregateSum(budgetFilter(b), month, month.AddDate(0, 1, -1), b.Currency)
+	if err != nil {
+		return res, err
+	}
+	res.Spent = spent
+	res.Over = res.Spent > b.Amount
+	return res, nil
+}
+
+// overBudgets returns the budgets of the owner covering sub that are exceeded in
+// the first month it is charged from now on; it only warns on errors, the check
+// never fails a request
+func (h *Handler) overBudgets(r *http.Request, sub *model.Subscription) []model.BudgetMonth {
+	now := time.Now().UTC()
+	month := maxMonth(time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), sub.BillingStart())
+	if sub.EndDate != nil && sub.EndDate.Before(month) {
+		return nil
+	}
+	budgets, err := h.repoFor(r).ListBudgets(sub.UserID)
+	if err != nil || len(budgets) == 0 {
+		if err != nil {
+			h.logger(r).Warnf("budget check failed: %v", err)
+		}
+		return nil
+	}
+	// an update without tags keeps the stored ones
+	tags := sub.Tags
+	if tags == nil && sub.ID != uuid.Nil {
+		if cur, err := h.repoFor(r).Get(sub.ID); err == nil && cur != nil {
+			tags = cur.Tags
+		}
+	}
+	service := h.serviceID(r, sub.ServiceName)
+	if sub.ServiceID != nil {
+		service = *sub.ServiceID
+	}
+	var res []model.BudgetMonth
+	for _, b := range budgets {
+		var budgetService uuid.UUID
+		if b.ServiceName != nil {
+			budgetService = h.serviceID(r, *b.ServiceName)
+		}
+		if !budgetCovers(b, budgetService, service, tags) {
+			continue
+		}
+		bm, err := h.budgetMonth(r, b, month)
+		if err != nil {
+			h.logger(r).Warnf("budget check failed: %v", err)
+			continue
+		}
+		if bm.Over {
+			res = append(res, bm)
+		}
+	}
+	return res
+}
+
+// overspend returns the budgets the saved change of sub pushed over, before
+// being the budgets that were already over without it
+func (h *Handler) overspend(r *http.Request, sub *model.Subscription, before []model.BudgetMonth) []model.BudgetMonth {
+	over := map[uuid.UUID]bool{}
+	for _, bm := range before {
+		over[bm.ID] = true
+	}
+	var res []model.BudgetMonth
+	for _, bm := range h.overBudgets(r, sub) {
+		if !over[bm.ID] {
+			h.logger(r).Infof("user %s is over budget %s in %s", sub.UserID, bm.ID, bm.Month)
+			res = append(res, bm)
+		}
+	}
+	return res
+}
+
+// serviceID returns the catalog service name is an alias of, uuid.Nil when
+// there is none or the lookup fails
+func (h *Handler) serviceID(r *http.Request, name string) uuid.UUID {
+	svc, err := h.repoFor(r).FindService(name)
+	if err != nil {
+		h.logger(r).Warnf("budget check failed: %v", err)
+		return uuid.Nil
+	}
+	if svc == nil {
+		return uuid.Nil
+	}
+	return svc.ID
+}
+
+// budgetCovers tells whether b covers a subscription to service with tags; a
+// service budget is matched through the catalog like budgetFilter does, so a
+// subscription entered under any alias of the service counts
+func budgetCovers(b model.Budget, budgetService, service uuid.UUID, tags []string) bool {
+	switch {
+	case b.ServiceName != nil:
+		return service != uuid.Nil && budgetService == service
+	case b.Category != nil:
+		for _, t := range tags {
+			if t == *b.Category {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// checkBudget writes a 404 unless the budget belongs to the caller,
+// admins and unauthenticated setups may delete any budget
+func (h *Handler) checkBudget(w http.ResponseWriter, r *http.Request, id uuid.UUID) bool {
+	p, ok := auth.FromContext(r.Context())
+	if !ok || p.AllUsers {
+		return true
+	}
+	budgets, err := h.repoFor(r).ListBudgets(p.UserID)
+	if err != nil {
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return false
+	}
+	for _, b := range budgets {
+		if b.ID == id {
+			return true
+		}
+	}
+	h.writeError(w, r, http.StatusNotFound, "not found")
+	return false
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/effectivemobile/subscriptions/internal/store"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+func TestBudgetReportHandler(t *testing.T) {
+	uid := uuid.New()
+	music := "music"
+	mr := &mockRepo{}
+	mr.budgetsFn = func(userID uuid.UUID) ([]model.Budget, error) {
+		return []model.Budget{
+			{UserID: uid, Amount: 100000, Currency: "RUB"},
+			{UserID: uid, Category: &music, Amount: 30000, Currency: "RUB"},
+		}, nil
+	}
+	calls := 0
+	mr.forecastFn = func(f store.Filter, from time.Time, months int, currency string) ([]model.Money, error) {
+		calls++
+		if *f.UserID != uid || f.ServiceName != nil || !from.Equal(time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)) || months != 2 {
+			t.Fatalf("unexpected forecast args: %+v %v %d", f, from, months)
+		}
+		if len(f.Tags) == 0 {
+			return []model.Money{90000, 90000}, nil
+		}
+		if f.Tags[0] != "music" {
+			t.Fatalf("unexpected tags %v", f.Tags)
+		}
+		return []model.Money{20000, 40000}, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	req := httptest.NewRequest(http.MethodGet, "/budgets/report?user_id="+uid.String()+"&from=07-2025&to=08-2025", nil)
+	rr := httptest.NewRecorder()
+
+	h.BudgetReport(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var res []model.BudgetMonth
+	readBody(t, rr.Body, &res)
+	want := []struct {
+		month string
+		spent model.Money
+		over  bool
+	}{
+		{"07-2025", 90000, false},
+		{"08-2025", 90000, false},
+		{"07-2025", 20000, false},
+		{"08-2025", 40000, true},
+	}
+	if len(res) != len(want) || calls != 2 {
+		t.Fatalf("unexpected report from %d queries: %+v", calls, res)
+	}
+	for i, w := range want {
+		if res[i].Month != w.month || res[i].Spent != w.spent || res[i].Over != w.over {
+			t.Fatalf("row %d = %+v; want %+v", i, res[i], w)
+		}
+	}
+}
+
+func TestCreateHandler_Overspend(t *testing.T) {
+	uid := uuid.New()
+	video, spotify := "video", "Spotify"
+	mr := &mockRepo{}
+	budgets := []model.Budget{
+		{ID: uuid.New(), UserID: uid, Category: &video, Amount: 10000, Currency: "RUB"},
+		{ID: uuid.New(), UserID: uid, ServiceName: &spotify, Amount: 1000, Currency: "RUB"},
+		{ID: uuid.New(), UserID: uid, Amount: 100000, Currency: "RUB"},
+	}
+	mr.budgetsFn = func(userID uuid.UUID) ([]model.Budget, error) {
+		return budgets, nil
+	}
+	created := false
+	mr.createFn = func(sub *model.Subscription) error {
+		created = true
+		return nil
+	}
+	mr.aggregateFn = func(f store.Filter, from, to time.Time, currency string) (model.Money, error) {
+		// the Spotify budget was over before, the overall one only with the new subscription
+		if f.ServiceName != nil {
+			return 5000, nil
+		}
+		if created {
+			return 150000, nil
+		}
+		return 90000, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	// the video budget does not cover a music subscription
+	b, _ := json.Marshal(map[string]interface{}{
+		"service_name": "Spotify",
+		"price":        1500,
+		"user_id":      uid.String(),
+		"start_date":   "01-2025",
+		"tags":         []string{"music"},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/subscriptions/", bytes.NewReader(b))
+	rr := httptest.NewRecorder()
+
+	h.Create(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var res model.SubscriptionResponse
+	readBody(t, rr.Body, &res)
+	if res.Subscription == nil || res.ServiceName != "Spotify" {
+		t.Fatalf("unexpected subscription: %+v", res.Subscription)
+	}
+	if len(res.Overspend) != 1 || res.Overspend[0].Category != nil || res.Overspend[0].Spent != 150000 || !res.Overspend[0].Over {
+		t.Fatalf("unexpected overspend: %+v", res.Overspend)
+	}
+}
+
+func TestCreateHandler_OverspendAlias(t *testing.T) {
+	uid, serviceID := uuid.New(), uuid.New()
+	name := "Yandex Plus"
+	mr := &mockRepo{}
+	mr.findSvcFn = func(n string) (*model.Service, error) {
+		switch model.ServiceKey(n) {
+		case "yandex plus", "яндекс плюс":
+			return &model.Service{ID: serviceID, Name: name}, nil
+		}
+		return nil, nil
+	}
+	mr.budgetsFn = func(userID uuid.UUID) ([]model.Budget, error) {
+		return []model.Budget{{ID: uuid.New(), UserID: uid, ServiceName: &name, Amount: 1000, Currency: "RUB"}}, nil
+	}
+	created := false
+	mr.createFn = func(sub *model.Subscription) error {
+		created = true
+		return nil
+	}
+	mr.aggregateFn = func(f store.Filter, from, to time.Time, currency string) (model.Money, error) {
+		if created {
+			return 1500, nil
+		}
+		return 0, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	// the subscription is entered under an alias of the budget's service
+	body := `{"service_name":"Яндекс Плюс","price":15,"user_id":"` + uid.String() + `","start_date":"01-2025"}`
+	rr := httptest.NewRecorder()
+	h.Create(rr, httptest.NewRequest(http.MethodPost, "/subscriptions/", strings.NewReader(body)))
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var res model.SubscriptionResponse
+	readBody(t, rr.Body, &res)
+	if len(res.Overspend) != 1 || *res.Overspend[0].ServiceName != name {
+		t.Fatalf("expected the budget of the aliased service to be over, got %+v", res.Overspend)
+	}
+}
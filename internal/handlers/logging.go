@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *Handler) GetLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	json.NewEncoder(w).Encode(model.LogLevel{Level: h.log.GetLevel().String()})
+}
+
+// SetLogLevel changes the level of the service log until it restarts
+func (h *Handler) SetLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	var req model.LogLevel
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.invalidBody(w, r, err)
+		return
+	}
+	if err := h.val.Struct(&req); err != nil {
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	lvl, err := logrus.ParseLevel(req.Level)
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if old := h.log.GetLevel(); old != lvl {
+		h.log.SetLevel(lvl)
+		h.logger(r).Warnf("log level changed from %s to %s", old, lvl)
+	}
+	json.NewEncoder(w).Encode(model.LogLevel{Level: lvl.String()})
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSetLogLevel(t *testing.T) {
+	log := logrus.New()
+	h := NewHandler(&mockRepo{}, log)
+
+	rr := httptest.NewRecorder()
+	h.SetLogLevel(rr, httptest.NewRequest(http.MethodPut, "/log-level", strings.NewReader(`{"level":"debug"}`)))
+	var res map[string]string
+	json.NewDecoder(rr.Body).Decode(&res)
+	if rr.Code != http.StatusOK || res["level"] != "debug" || log.GetLevel() != logrus.DebugLevel {
+		t.Fatalf("expected the level to change, got %d %v %v", rr.Code, res, log.GetLevel())
+	}
+
+	rr = httptest.NewRecorder()
+	h.SetLogLevel(rr, httptest.NewRequest(http.MethodPut, "/log-level", strings.NewReader(`{"level":"loud"}`)))
+	if rr.Code != http.StatusBadRequest || log.GetLevel() != logrus.DebugLevel {
+		t.Fatalf("expected 400 for an unknown level, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	h.SetLogLevel(rr, asUser(httptest.NewRequest(http.MethodPut, "/log-level", strings.NewReader(`{"level":"error"}`)), uuid.New(), false))
+	if rr.Code != http.StatusForbidden || log.GetLevel() != logrus.DebugLevel {
+		t.Fatalf("expected 403 for a non-admin, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	h.GetLogLevel(rr, httptest.NewRequest(http.MethodGet, "/log-level", nil))
+	if !strings.Contains(rr.Body.String(), `"level":"debug"`) {
+		t.Fatalf("unexpected level: %s", rr.Body.String())
+	}
+}
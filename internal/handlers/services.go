@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/effectivemobile/subscriptions/internal/store"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultServiceLimit = 10
+	maxServiceLimit     = 50
+)
+
+// SearchServices autocompletes service names from the catalog
+func (h *Handler) SearchServices(w http.ResponseWriter, r *http.Request) {
+	limit := defaultServiceLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxServiceLimit {
+			h.writeError(w, r, http.StatusBadRequest, "limit must be an integer between 1 and "+strconv.Itoa(maxServiceLimit))
+			return
+		}
+		limit = n
+	}
+	res, err := h.repoFor(r).SearchServices(r.URL.Query().Get("q"), limit)
+	if err != nil {
+		h.logger(r).Errorf("search services failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// CreateService adds a service to the catalog shared by all users. Admins only.
+func (h *Handler) CreateService(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	var req model.ServiceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.invalidBody(w, r, err)
+		return
+	}
+	req.Currency = currencyCode(req.Currency)
+	if err := h.val.Struct(&req); err != nil {
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if model.ServiceKey(req.Name) == "" {
+		h.writeError(w, r, http.StatusBadRequest, "name must not be blank")
+		return
+	}
+	svc := &model.Service{
+		Name:         req.Name,
+		DefaultPrice: req.DefaultPrice,
+		Currency:     req.Currency,
+		Aliases:      req.Aliases,
+	}
+	if err := h.repoFor(r).CreateService(svc); err != nil {
+		if errors.Is(err, store.ErrServiceExists) {
+			h.writeError(w, r, http.StatusConflict, err.Error())
+			return
+		}
+		h.logger(r).Errorf("create service failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to create")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(svc)
+}
+
+// AddAliases adds names to a catalog service; services already known under one
+// of them are merged into it along with their subscriptions. Admins only.
+func (h *Handler) AddAliases(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var req model.AliasesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.invalidBody(w, r, err)
+		return
+	}
+	if err := h.val.Struct(&req); err != nil {
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	svc, err := h.repoFor(r).AddAliases(id, req.Aliases)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			h.writeError(w, r, http.StatusNotFound, "not found")
+			return
+		}
+		h.logger(r).Errorf("add aliases failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to add aliases")
+		return
+	}
+	json.NewEncoder(w).Encode(svc)
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSearchServicesHandler(t *testing.T) {
+	mr := &mockRepo{}
+	mr.searchFn = func(query string, limit int) ([]model.Service, error) {
+		if query != "yan" || limit != 10 {
+			t.Fatalf("unexpected search args: %q %d", query, limit)
+		}
+		return []model.Service{{ID: uuid.New(), Name: "Yandex Plus", Aliases: []string{"yandex plus", "яндекс плюс"}}}, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	req := httptest.NewRequest(http.MethodGet, "/services/?q=yan", nil)
+	rr := httptest.NewRecorder()
+
+	h.SearchServices(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var res []model.Service
+	readBody(t, rr.Body, &res)
+	if len(res) != 1 || res[0].Name != "Yandex Plus" {
+		t.Fatalf("unexpected services: %+v", res)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/services/?q=yan&limit=500", nil)
+	rr = httptest.NewRecorder()
+	h.SearchServices(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a large limit, got %d", rr.Code)
+	}
+}
+
+func TestCreateHandler_CatalogPrice(t *testing.T) {
+	price := model.Money(39900)
+	mr := &mockRepo{}
+	mr.findSvcFn = func(name string) (*model.Service, error) {
+		if name == "Yandex Plus" {
+			return &model.Service{Name: "Yandex Plus", DefaultPrice: &price, Currency: "RUB"}, nil
+		}
+		return nil, nil
+	}
+	mr.createFn = func(sub *model.Subscription) error {
+		if sub.Price != price || sub.Currency != "RUB" {
+			t.Fatalf("expected the catalog price, got %v %s", sub.Price, sub.Currency)
+		}
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	for name, code := range map[string]int{"Yandex Plus": http.StatusCreated, "Unknown": http.StatusBadRequest} {
+		b, _ := json.Marshal(map[string]interface{}{
+			"service_name": name,
+			"user_id":      uuid.New().String(),
+			"start_date":   "07-2025",
+		})
+		rr := httptest.NewRecorder()
+		h.Create(rr, httptest.NewRequest(http.MethodPost, "/subscriptions/", bytes.NewReader(b)))
+		if rr.Code != code {
+			t.Fatalf("%s: expected %d, got %d: %s", name, code, rr.Code, rr.Body.String())
+		}
+	}
+
+	// the default price is in RUB, it can't be taken for a subscription in USD
+	b, _ := json.Marshal(map[string]interface{}{
+		"service_name": "Yandex Plus",
+		"user_id":      uuid.New().String(),
+		"start_date":   "07-2025",
+		"currency":     "USD",
+	})
+	rr := httptest.NewRecorder()
+	h.Create(rr, httptest.NewRequest(http.MethodPost, "/subscriptions/", bytes.NewReader(b)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a currency other than the catalog's, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestUpdateHandler_ZeroPriceKept(t *testing.T) {
+	id, uid := uuid.New(), uuid.New()
+	price := model.Money(39900)
+	mr := &mockRepo{}
+	mr.getFn = func(uuid.UUID) (*model.Subscription, error) {
+		return &model.Subscription{ID: id, ServiceName: "Yandex Plus", Price: price, UserID: uid, Currency: "RUB",
+			StartDate: time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC), BillingDay: 1}, nil
+	}
+	mr.findSvcFn = func(name string) (*model.Service, error) {
+		return &model.Service{Name: "Yandex Plus", DefaultPrice: &price, Currency: "RUB"}, nil
+	}
+	mr.updateFn = func(sub *model.Subscription, priceFrom time.Time) error {
+		if sub.Price != 0 {
+			t.Fatalf("expected the explicit price of 0 to be kept, got %v", sub.Price)
+		}
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	put := `{"service_name":"Yandex Plus","price":0,"user_id":"` + uid.String() + `","start_date":"07-2025"}`
+	rr := httptest.NewRecorder()
+	h.Update(rr, withURLParam(httptest.NewRequest(http.MethodPut, "/subscriptions/"+id.String(), strings.NewReader(put)), "id", id.String()))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("put: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	h.Patch(rr, withURLParam(httptest.NewRequest(http.MethodPatch, "/subscriptions/"+id.String(), strings.NewReader(`{"price":0}`)), "id", id.String()))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("patch: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -1,18 +1,35 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/effectivemobile/subscriptions/internal/auth"
+	"github.com/effectivemobile/subscriptions/internal/ical"
+	"github.com/effectivemobile/subscriptions/internal/logging"
 	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/effectivemobile/subscriptions/internal/query"
 	"github.com/effectivemobile/subscriptions/internal/store"
+	"github.com/effectivemobile/subscriptions/internal/tracing"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	monthYearLayout   = "01-2006"
+	maxForecastMonths = 36
+	maxRenewalDays    = 365
+)
+
 type Handler struct {
 	repo store.Repository
 	log  *logrus.Logger
@@ -23,58 +40,63 @@ func NewHandler(r store.Repository, l *logrus.Logger) *Handler {
 	return &Handler{repo: r, log: l, val: validator.New()}
 }
 
+// repoFor returns the repository bound to the request, so that its queries are
+// cancelled with the request and traced as part of it
+func (h *Handler) repoFor(r *http.Request) store.Repository {
+	return h.repo.WithContext(r.Context())
+}
+
+// logger returns the log of the request, its entries carry the request
+// fields and the trace id
+func (h *Handler) logger(r *http.Request) *logrus.Entry {
+	if l, ok := logging.FromContext(r.Context()); ok {
+		return l
+	}
+	return h.log.WithContext(r.Context())
+}
+
 func (h *Handler) Create(w http.ResponseWriter, r *http.Request) {
 	var req model.SubscriptionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.log.Warnf("invalid create body: %v", err)
-		h.writeError(w, http.StatusBadRequest, "invalid body")
+		h.logger(r).Warnf("invalid create body: %v", err)
+		h.invalidBody(w, r, err)
 		return
 	}
+	req.Currency = currencyCode(req.Currency)
 	if err := h.val.Struct(&req); err != nil {
-		h.writeError(w, http.StatusBadRequest, err.Error())
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	uid, _ := uuid.Parse(req.UserID)
-	start, err := parseMonthYear(req.StartDate)
+	sub, err := subscriptionFromRequest(&req)
 	if err != nil {
-		h.writeError(w, http.StatusBadRequest, "invalid start_date format, expected MM-YYYY")
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	var end *time.Time
-	if req.EndDate != nil {
-		et, err := parseMonthYear(*req.EndDate)
-		if err != nil {
-			h.writeError(w, http.StatusBadRequest, "invalid end_date format, expected MM-YYYY")
-			return
-		}
-		end = &et
+	if _, ok := h.scopeUser(w, r, &sub.UserID); !ok {
+		return
 	}
-	sub := &model.Subscription{
-		ServiceName: req.ServiceName,
-		Price:       req.Price,
-		UserID:      uid,
-		StartDate:   start,
-		EndDate:     end,
+	if !h.catalogPrice(w, r, req.Price, sub) {
+		return
 	}
-	if err := h.repo.Create(sub); err != nil {
-		h.log.Errorf("create failed: %v", err)
-		h.writeError(w, http.StatusInternalServerError, "failed to create")
+	before := h.overBudgets(r, sub)
+	if err := h.repoFor(r).Create(sub); err != nil {
+		h.logger(r).Errorf("create failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to create")
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(sub)
+	json.NewEncoder(w).Encode(model.SubscriptionResponse{Subscription: sub, Overspend: h.overspend(r, sub, before)})
 }
 
 func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, err := uuid.Parse(idStr)
 	if err != nil {
-		h.writeError(w, http.StatusBadRequest, "invalid id")
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
 		return
 	}
-	s, err := h.repo.Get(id)
-	if err != nil {
-		h.writeError(w, http.StatusNotFound, "not found")
+	s, ok := h.readSubscription(w, r, id)
+	if !ok {
 		return
 	}
 	json.NewEncoder(w).Encode(s)
@@ -84,78 +106,148 @@ func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, err := uuid.Parse(idStr)
 	if err != nil {
-		h.writeError(w, http.StatusBadRequest, "invalid id")
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
 		return
 	}
 	var req model.SubscriptionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.writeError(w, http.StatusBadRequest, "invalid body")
+		h.invalidBody(w, r, err)
 		return
 	}
-	if err := h.val.Struct(&req); err != nil {
-		h.writeError(w, http.StatusBadRequest, err.Error())
+	if _, ok := h.ownSubscription(w, r, id); !ok {
 		return
 	}
-	uid, _ := uuid.Parse(req.UserID)
-	start, err := parseMonthYear(req.StartDate)
+	h.update(w, r, id, &req)
+}
+
+// Patch changes only the fields present in the body, the others keep their
+// stored values; it is saved like Update
+func (h *Handler) Patch(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
 	if err != nil {
-		h.writeError(w, http.StatusBadRequest, "invalid start_date format, expected MM-YYYY")
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
 		return
 	}
-	var end *time.Time
-	if req.EndDate != nil {
-		et, err := parseMonthYear(*req.EndDate)
-		if err != nil {
-			h.writeError(w, http.StatusBadRequest, "invalid end_date format, expected MM-YYYY")
+	cur, ok := h.ownSubscription(w, r, id)
+	if !ok {
+		return
+	}
+	req := requestFromSubscription(cur)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.invalidBody(w, r, err)
+		return
+	}
+	h.update(w, r, id, &req)
+}
+
+// update saves req over the subscription id, which the caller may change
+func (h *Handler) update(w http.ResponseWriter, r *http.Request, id uuid.UUID, req *model.SubscriptionRequest) {
+	req.Currency = currencyCode(req.Currency)
+	if err := h.val.Struct(req); err != nil {
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	sub, err := subscriptionFromRequest(req)
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := h.scopeUser(w, r, &sub.UserID); !ok {
+		return
+	}
+	if !h.catalogPrice(w, r, req.Price, sub) {
+		return
+	}
+	sub.ID = id
+	// a price change applies from the current month unless told otherwise, never
+	// before the start; an ended subscription changes its price in its last month
+	now := time.Now().UTC()
+	priceFrom := maxMonth(time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), sub.StartDate)
+	if sub.EndDate != nil && priceFrom.After(*sub.EndDate) {
+		priceFrom = *sub.EndDate
+	}
+	if req.PriceEffectiveFrom != nil {
+		if priceFrom, err = parseMonthYear(*req.PriceEffectiveFrom); err != nil {
+			h.writeError(w, r, http.StatusBadRequest, "invalid price_effective_from format, expected MM-YYYY")
+			return
+		}
+		if priceFrom.Before(sub.StartDate) {
+			h.writeError(w, r, http.StatusBadRequest, "price_effective_from must not be before start_date")
+			return
+		}
+		if sub.EndDate != nil && priceFrom.After(*sub.EndDate) {
+			h.writeError(w, r, http.StatusBadRequest, "price_effective_from must not be after end_date")
 			return
 		}
-		end = &et
-	}
-	sub := &model.Subscription{
-		ID:          id,
-		ServiceName: req.ServiceName,
-		Price:       req.Price,
-		UserID:      uid,
-		StartDate:   start,
-		EndDate:     end,
 	}
-	if err := h.repo.Update(sub); err != nil {
-		h.writeError(w, http.StatusInternalServerError, "failed to update")
+	before := h.overBudgets(r, sub)
+	if err := h.repoFor(r).Update(sub, priceFrom); err != nil {
+		h.writeError(w, r, http.StatusInternalServerError, "failed to update")
 		return
 	}
-	json.NewEncoder(w).Encode(sub)
+	json.NewEncoder(w).Encode(model.SubscriptionResponse{Subscription: sub, Overspend: h.overspend(r, sub, before)})
 }
 
 func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, err := uuid.Parse(idStr)
 	if err != nil {
-		h.writeError(w, http.StatusBadRequest, "invalid id")
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
+		return
+	}
+	if !h.checkSubscription(w, r, id) {
 		return
 	}
-	if err := h.repo.Delete(id); err != nil {
-		h.writeError(w, http.StatusInternalServerError, "failed to delete")
+	if err := h.repoFor(r).Delete(id); err != nil {
+		h.writeError(w, r, http.StatusInternalServerError, "failed to delete")
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
-	filter := map[string]interface{}{}
-	if uid := r.URL.Query().Get("user_id"); uid != "" {
-		if u, err := uuid.Parse(uid); err == nil {
-			filter["user_id"] = u
-		} else {
-			h.writeError(w, http.StatusBadRequest, "invalid user_id")
+	filter, ok := h.filterParams(w, r)
+	if !ok {
+		return
+	}
+	if v := r.URL.Query().Get("q"); v != "" {
+		if err := query.Parse(v, &filter); err != nil {
+			var se *query.SyntaxError
+			if errors.As(err, &se) {
+				body := map[string]interface{}{"error": "invalid q: " + se.Msg, "position": se.Pos}
+				if id := tracing.TraceIDFromContext(r.Context()); id != "" {
+					body["trace_id"] = id
+				}
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(body)
+				return
+			}
+			h.writeError(w, r, http.StatusBadRequest, "invalid q")
+			return
+		}
+		// user: in the query is subject to the same scoping as user_id
+		if filter.UserID, ok = h.scopeUser(w, r, filter.UserID); !ok {
 			return
 		}
 	}
-	if s := r.URL.Query().Get("service_name"); s != "" {
-		filter["service_name"] = s
+	if v := r.URL.Query().Get("trial_ending_within"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 || days > maxRenewalDays {
+			h.writeError(w, r, http.StatusBadRequest, "trial_ending_within must be an integer between 0 and "+strconv.Itoa(maxRenewalDays))
+			return
+		}
+		// a trial ends on the last day of its trial_end month, so select
+		// the months from the current one up to the last that ends in the window
+		now := time.Now().UTC()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		limit := today.AddDate(0, 0, days+1)
+		trialFrom := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+		trialTo := time.Date(limit.Year(), limit.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+		filter.TrialEndFrom, filter.TrialEndTo = &trialFrom, &trialTo
 	}
-	res, err := h.repo.List(filter)
+	res, err := h.repoFor(r).List(filter)
 	if err != nil {
-		h.writeError(w, http.StatusInternalServerError, "failed")
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
 		return
 	}
 	json.NewEncoder(w).Encode(res)
@@ -165,53 +257,716 @@ func (h *Handler) Aggregate(w http.ResponseWriter, r *http.Request) {
 	fromStr := r.URL.Query().Get("from")
 	toStr := r.URL.Query().Get("to")
 	if fromStr == "" || toStr == "" {
-		h.writeError(w, http.StatusBadRequest, "from and to are required in MM-YYYY format")
+		h.writeError(w, r, http.StatusBadRequest, "from and to are required in MM-YYYY format")
 		return
 	}
 	from, err := parseMonthYear(fromStr)
 	if err != nil {
-		h.writeError(w, http.StatusBadRequest, "invalid from format")
+		h.writeError(w, r, http.StatusBadRequest, "invalid from format")
 		return
 	}
 	// set from to first day of month
 	from = time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
 	toMonth, err := parseMonthYear(toStr)
 	if err != nil {
-		h.writeError(w, http.StatusBadRequest, "invalid to format")
+		h.writeError(w, r, http.StatusBadRequest, "invalid to format")
 		return
 	}
 	// set to to last day of month
 	to := time.Date(toMonth.Year(), toMonth.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, -1)
 
+	f, ok := h.filterParams(w, r)
+	if !ok {
+		return
+	}
+	currency, ok := h.currencyParam(w, r)
+	if !ok {
+		return
+	}
+	groupBy := r.URL.Query().Get("group_by")
+	if groupBy != "" && groupBy != "category" {
+		h.writeError(w, r, http.StatusBadRequest, "group_by must be category")
+		return
+	}
+	res, err := h.repoFor(r).AggregateSum(f, from, to, currency)
+	if err != nil {
+		if errors.Is(err, store.ErrNoRate) {
+			h.writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		h.writeError(w, r, http.StatusInternalServerError, "aggregation failed")
+		return
+	}
+	total := model.AggregateTotal{Total: res, Currency: currency}
+	if groupBy == "category" {
+		if total.Categories, err = h.repoFor(r).AggregateByTag(f, from, to, currency); err != nil {
+			h.logger(r).Errorf("aggregate by tag failed: %v", err)
+			h.writeError(w, r, http.StatusInternalServerError, "aggregation failed")
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(total)
+}
+
+func (h *Handler) Forecast(w http.ResponseWriter, r *http.Request) {
+	months, err := strconv.Atoi(r.URL.Query().Get("months"))
+	if err != nil || months < 1 || months > maxForecastMonths {
+		h.writeError(w, r, http.StatusBadRequest, "months must be an integer between 1 and "+strconv.Itoa(maxForecastMonths))
+		return
+	}
+	f, ok := h.filterParams(w, r)
+	if !ok {
+		return
+	}
+	// forecast starts with the current month
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	currency, ok := h.currencyParam(w, r)
+	if !ok {
+		return
+	}
+	totals, err := h.repoFor(r).ForecastSum(f, from, months, currency)
+	if err != nil {
+		if errors.Is(err, store.ErrNoRate) {
+			h.writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		h.logger(r).Errorf("forecast failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "forecast failed")
+		return
+	}
+	res := make([]model.MonthTotal, 0, len(totals))
+	for i, t := range totals {
+		res = append(res, model.MonthTotal{Month: from.AddDate(0, i, 0).Format(monthYearLayout), Total: t, Currency: currency})
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) Renewals(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 1 || d > maxRenewalDays {
+			h.writeError(w, r, http.StatusBadRequest, "days must be an integer between 1 and "+strconv.Itoa(maxRenewalDays))
+			return
+		}
+		days = d
+	}
+	order := r.URL.Query().Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		h.writeError(w, r, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+	var uid *uuid.UUID
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			h.writeError(w, r, http.StatusBadRequest, "invalid user_id")
+			return
+		}
+		uid = &id
+	}
+	uid, ok := h.scopeUser(w, r, uid)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, days)
+	res, err := h.repoFor(r).Renewals(uid, from, to)
+	if err != nil {
+		h.logger(r).Errorf("renewals failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return
+	}
+	// repository returns renewals ordered by date ascending
+	if order == "desc" {
+		for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+			res[i], res[j] = res[j], res[i]
+		}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) Calendar(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(r.URL.Query().Get("user_id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "user_id is required")
+		return
+	}
+	if _, ok := h.scopeUser(w, r, &uid); !ok {
+		return
+	}
+	h.writeCalendar(w, r, uid)
+}
+
+// CalendarFeed is Calendar for calendar apps, which can't send credentials:
+// the token of the URL, issued by CreateCalendarToken, tells the user
+func (h *Handler) CalendarFeed(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		h.writeError(w, r, http.StatusBadRequest, "token is required")
+		return
+	}
+	uid, err := h.repoFor(r).FindCalendarToken(auth.HashFeedToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		h.writeError(w, r, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		h.logger(r).Errorf("find calendar token failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return
+	}
+	h.writeCalendar(w, r, uid)
+}
+
+// CreateCalendarToken issues the feed URL of a user, replacing the previous
+// one; the token is only in this response
+func (h *Handler) CreateCalendarToken(w http.ResponseWriter, r *http.Request) {
+	uid, ok := h.calendarUser(w, r)
+	if !ok {
+		return
+	}
+	token, hash, err := auth.NewFeedToken()
+	if err != nil {
+		h.logger(r).Errorf("generate calendar token failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to create")
+		return
+	}
+	if err := h.repoFor(r).SetCalendarToken(uid, hash); err != nil {
+		h.logger(r).Errorf("set calendar token failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to create")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(model.CalendarToken{Token: token, URL: "/calendar.ics?token=" + token})
+}
+
+// RevokeCalendarToken disables the feed URL of a user
+func (h *Handler) RevokeCalendarToken(w http.ResponseWriter, r *http.Request) {
+	uid, ok := h.calendarUser(w, r)
+	if !ok {
+		return
+	}
+	err := h.repoFor(r).DeleteCalendarToken(uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.writeError(w, r, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		h.logger(r).Errorf("revoke calendar token failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to revoke")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// calendarUser is the user whose feed token is managed: the caller, or
+// user_id for admins and without authentication
+func (h *Handler) calendarUser(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	var uid *uuid.UUID
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			h.writeError(w, r, http.StatusBadRequest, "invalid user_id")
+			return uuid.Nil, false
+		}
+		uid = &id
+	}
+	uid, ok := h.scopeUser(w, r, uid)
+	if !ok {
+		return uuid.Nil, false
+	}
+	if uid == nil {
+		h.writeError(w, r, http.StatusBadRequest, "user_id is required")
+		return uuid.Nil, false
+	}
+	return *uid, true
+}
+
+func (h *Handler) writeCalendar(w http.ResponseWriter, r *http.Request, uid uuid.UUID) {
+	subs, err := h.repoFor(r).List(store.Filter{UserID: &uid})
+	if err != nil {
+		h.logger(r).Errorf("calendar failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="subscriptions.ics"`)
+	if err := ical.Write(w, subs, time.Now()); err != nil {
+		h.logger(r).Errorf("calendar write failed: %v", err)
+	}
+}
+
+func (h *Handler) Pause(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var req model.PauseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.invalidBody(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	pause := &model.Pause{
+		SubscriptionID: id,
+		StartDate:      time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC),
+	}
+	if req.From != nil {
+		if pause.StartDate, err = parseMonthYear(*req.From); err != nil {
+			h.writeError(w, r, http.StatusBadRequest, "invalid from format, expected MM-YYYY")
+			return
+		}
+	}
+	if req.To != nil {
+		to, err := parseMonthYear(*req.To)
+		if err != nil {
+			h.writeError(w, r, http.StatusBadRequest, "invalid to format, expected MM-YYYY")
+			return
+		}
+		if to.Before(pause.StartDate) {
+			h.writeError(w, r, http.StatusBadRequest, "to must not be before from")
+			return
+		}
+		pause.EndDate = &to
+	}
+	if _, ok := h.ownSubscription(w, r, id); !ok {
+		return
+	}
+	if err := h.repoFor(r).Pause(pause); err != nil {
+		if errors.Is(err, store.ErrPauseOverlap) {
+			h.writeError(w, r, http.StatusConflict, err.Error())
+			return
+		}
+		h.logger(r).Errorf("pause failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to pause")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pause)
+}
+
+func (h *Handler) Resume(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var req model.ResumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.invalidBody(w, r, err)
+		return
+	}
+	// an unknown id is a 404, not a subscription that is not paused
+	if _, ok := h.ownSubscription(w, r, id); !ok {
+		return
+	}
+	month := time.Now().UTC()
+	if req.Month != nil {
+		if month, err = parseMonthYear(*req.Month); err != nil {
+			h.writeError(w, r, http.StatusBadRequest, "invalid month format, expected MM-YYYY")
+			return
+		}
+	}
+	if err := h.repoFor(r).Resume(id, month); err != nil {
+		if errors.Is(err, store.ErrNotPaused) {
+			h.writeError(w, r, http.StatusConflict, err.Error())
+			return
+		}
+		h.logger(r).Errorf("resume failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to resume")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) Pauses(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
+		return
+	}
+	if !h.checkSubscription(w, r, id) {
+		return
+	}
+	res, err := h.repoFor(r).ListPauses(id)
+	if err != nil {
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) Prices(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
+		return
+	}
+	if !h.checkSubscription(w, r, id) {
+		return
+	}
+	res, err := h.repoFor(r).ListPrices(id)
+	if err != nil {
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) SetMembers(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var req model.MembersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.invalidBody(w, r, err)
+		return
+	}
+	if err := h.val.Struct(&req); err != nil {
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	sub, ok := h.ownSubscription(w, r, id)
+	if !ok {
+		return
+	}
+	if err := checkMembers(sub, &req); err != nil {
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Members == nil {
+		req.Members = []model.Member{}
+	}
+	if err := h.repoFor(r).SetMembers(id, req.Split, req.Members); err != nil {
+		h.logger(r).Errorf("set members failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to set members")
+		return
+	}
+	json.NewEncoder(w).Encode(req)
+}
+
+func (h *Handler) Members(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid id")
+		return
+	}
+	sub, ok := h.readSubscription(w, r, id)
+	if !ok {
+		return
+	}
+	members, err := h.repoFor(r).ListMembers(id)
+	if err != nil {
+		h.writeError(w, r, http.StatusInternalServerError, "failed")
+		return
+	}
+	json.NewEncoder(w).Encode(model.MembersRequest{Split: sub.Split, Members: members})
+}
+
+// Settlement returns who owes whom for shared subscriptions over a period
+func (h *Handler) Settlement(w http.ResponseWriter, r *http.Request) {
+	fromStr := r.URL.Query().Get("from")
+	toStr := r.URL.Query().Get("to")
+	if fromStr == "" || toStr == "" {
+		h.writeError(w, r, http.StatusBadRequest, "from and to are required in MM-YYYY format")
+		return
+	}
+	from, err := parseMonthYear(fromStr)
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid from format")
+		return
+	}
+	toMonth, err := parseMonthYear(toStr)
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid to format")
+		return
+	}
+	if toMonth.Before(from) {
+		h.writeError(w, r, http.StatusBadRequest, "to must not be before from")
+		return
+	}
+	to := toMonth.AddDate(0, 1, -1)
 	var uid *uuid.UUID
 	if v := r.URL.Query().Get("user_id"); v != "" {
 		id, err := uuid.Parse(v)
 		if err != nil {
-			h.writeError(w, http.StatusBadRequest, "invalid user_id")
+			h.writeError(w, r, http.StatusBadRequest, "invalid user_id")
 			return
 		}
 		uid = &id
 	}
-	var serviceName *string
-	if v := r.URL.Query().Get("service_name"); v != "" {
-		serviceName = &v
+	uid, ok := h.scopeUser(w, r, uid)
+	if !ok {
+		return
+	}
+	currency, ok := h.currencyParam(w, r)
+	if !ok {
+		return
 	}
-	res, err := h.repo.AggregateSum(uid, serviceName, from, to)
+	res, err := h.repoFor(r).Settlement(uid, from, to, currency)
 	if err != nil {
-		h.writeError(w, http.StatusInternalServerError, "aggregation failed")
+		if errors.Is(err, store.ErrNoRate) {
+			h.writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		h.logger(r).Errorf("settlement failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "settlement failed")
 		return
 	}
-	json.NewEncoder(w).Encode(map[string]int64{"total": res})
+	json.NewEncoder(w).Encode(res)
 }
 
 // utilities
 
-func (h *Handler) writeError(w http.ResponseWriter, code int, msg string) {
+// filterParams reads the subscription filter shared by List, Aggregate and
+// Forecast, writing a 400 if a parameter is invalid; the user is scoped to the caller
+func (h *Handler) filterParams(w http.ResponseWriter, r *http.Request) (store.Filter, bool) {
+	var f store.Filter
+	q := r.URL.Query()
+	if v := q.Get("user_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			h.writeError(w, r, http.StatusBadRequest, "invalid user_id")
+			return f, false
+		}
+		f.UserID = &id
+	}
+	if v := q.Get("service_name"); v != "" {
+		f.ServiceName = &v
+	}
+	match, err := store.ParseMatchMode(q.Get("match"))
+	if err != nil {
+		h.writeError(w, r, http.StatusBadRequest, err.Error())
+		return f, false
+	}
+	f.Match = match
+	if v := q.Get("similarity"); v != "" {
+		if f.Similarity, err = strconv.ParseFloat(v, 64); err != nil || f.Similarity <= 0 || f.Similarity > 1 {
+			h.writeError(w, r, http.StatusBadRequest, "similarity must be a number in (0, 1]")
+			return f, false
+		}
+	}
+	if v := q.Get("case_sensitive"); v != "" {
+		if f.CaseSensitive, err = strconv.ParseBool(v); err != nil {
+			h.writeError(w, r, http.StatusBadRequest, "case_sensitive must be true or false")
+			return f, false
+		}
+	}
+	if v := q.Get("tag"); v != "" {
+		f.Tags = []string{strings.ToLower(strings.TrimSpace(v))}
+	}
+	var ok bool
+	f.UserID, ok = h.scopeUser(w, r, f.UserID)
+	return f, ok
+}
+
+// currencyParam reads the target currency of totals, writing a 400 if it is invalid
+func (h *Handler) currencyParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	v := currencyCode(r.URL.Query().Get("currency"))
+	if v == "" {
+		return model.BaseCurrency, true
+	}
+	if err := h.val.Var(v, "iso4217"); err != nil {
+		h.writeError(w, r, http.StatusBadRequest, "invalid currency, expected an ISO 4217 code")
+		return "", false
+	}
+	return v, true
+}
+
+// currencyCode normalizes an ISO 4217 code, which clients may send in any case;
+// parameters and bodies go through it before they are validated
+func currencyCode(v string) string {
+	return strings.ToUpper(strings.TrimSpace(v))
+}
+
+// catalogPrice fills the price of sub from the service catalog when the
+// request omitted it, writing a 400 if the service has no default price or it
+// is in another currency than the one requested; a price of 0 is kept
+func (h *Handler) catalogPrice(w http.ResponseWriter, r *http.Request, price *model.Money, sub *model.Subscription) bool {
+	if price != nil {
+		return true
+	}
+	svc, err := h.repoFor(r).FindService(sub.ServiceName)
+	if err != nil {
+		h.logger(r).Errorf("find service failed: %v", err)
+		h.writeError(w, r, http.StatusInternalServerError, "failed to look up the service")
+		return false
+	}
+	if svc == nil || svc.DefaultPrice == nil {
+		h.writeError(w, r, http.StatusBadRequest, "price is required, the service has no default price")
+		return false
+	}
+	if sub.Currency != "" && sub.Currency != svc.Currency {
+		h.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("price is required, the default price of the service is in %s", svc.Currency))
+		return false
+	}
+	sub.Price = *svc.DefaultPrice
+	sub.Currency = svc.Currency
+	return true
+}
+
+func maxMonth(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// subscriptionFromRequest converts a validated request body into a model,
+// the returned error message is safe to show to the client
+func subscriptionFromRequest(req *model.SubscriptionRequest) (*model.Subscription, error) {
+	uid, _ := uuid.Parse(req.UserID)
+	start, err := parseMonthYear(req.StartDate)
+	if err != nil {
+		return nil, errors.New("invalid start_date format, expected MM-YYYY")
+	}
+	var end *time.Time
+	if req.EndDate != nil {
+		et, err := parseMonthYear(*req.EndDate)
+		if err != nil {
+			return nil, errors.New("invalid end_date format, expected MM-YYYY")
+		}
+		end = &et
+	}
+	var trialEnd *time.Time
+	if req.TrialEnd != nil {
+		tt, err := parseMonthYear(*req.TrialEnd)
+		if err != nil {
+			return nil, errors.New("invalid trial_end format, expected MM-YYYY")
+		}
+		if tt.Before(start) {
+			return nil, errors.New("trial_end must not be before start_date")
+		}
+		trialEnd = &tt
+	}
+	if req.Discount != nil {
+		if err := req.Discount.Check(); err != nil {
+			return nil, err
+		}
+	}
+	billingDay := 1
+	if req.BillingDay != nil {
+		billingDay = *req.BillingDay
+	}
+	var tags []string
+	if req.Tags != nil {
+		tags = normalizeTags(req.Tags)
+	}
+	var price model.Money
+	if req.Price != nil {
+		price = *req.Price
+	}
+	return &model.Subscription{
+		Currency:    req.Currency,
+		ServiceName: req.ServiceName,
+		Price:       price,
+		UserID:      uid,
+		StartDate:   start,
+		EndDate:     end,
+		BillingDay:  billingDay,
+		TrialEnd:    trialEnd,
+		Discount:    req.Discount,
+		Tags:        tags,
+	}, nil
+}
+
+// requestFromSubscription is the request body that saves sub unchanged
+func requestFromSubscription(sub *model.Subscription) model.SubscriptionRequest {
+	billingDay := sub.BillingDay
+	price := sub.Price
+	req := model.SubscriptionRequest{
+		ServiceName: sub.ServiceName,
+		Price:       &price,
+		UserID:      sub.UserID.String(),
+		StartDate:   sub.StartDate.Format(monthYearLayout),
+		BillingDay:  &billingDay,
+		Currency:    sub.Currency,
+		Discount:    sub.Discount,
+		Tags:        sub.Tags,
+	}
+	if sub.EndDate != nil {
+		end := sub.EndDate.Format(monthYearLayout)
+		req.EndDate = &end
+	}
+	if sub.TrialEnd != nil {
+		trialEnd := sub.TrialEnd.Format(monthYearLayout)
+		req.TrialEnd = &trialEnd
+	}
+	return req
+}
+
+// normalizeTags lower-cases and trims tags, dropping duplicates
+func normalizeTags(tags []string) []string {
+	res := make([]string, 0, len(tags))
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		res = append(res, t)
+	}
+	return res
+}
+
+// checkMembers validates members against the split rule of the request,
+// the returned error message is safe to show to the client
+func checkMembers(sub *model.Subscription, req *model.MembersRequest) error {
+	seen := map[uuid.UUID]bool{}
+	percent := 0
+	for _, m := range req.Members {
+		if m.UserID == sub.UserID {
+			return errors.New("owner cannot be a member of own subscription")
+		}
+		if seen[m.UserID] {
+			return errors.New("duplicate member " + m.UserID.String())
+		}
+		seen[m.UserID] = true
+		switch req.Split {
+		case model.SplitPercent:
+			if m.Percent == nil || m.Amount != nil {
+				return errors.New("percent split requires percent for every member")
+			}
+			percent += *m.Percent
+		case model.SplitFixed:
+			if m.Amount == nil || m.Percent != nil {
+				return errors.New("fixed split requires amount for every member")
+			}
+		default:
+			if m.Percent != nil || m.Amount != nil {
+				return errors.New("equal split takes no percent or amount")
+			}
+		}
+	}
+	if percent > 100 {
+		return errors.New("member percents must not exceed 100 in total")
+	}
+	return nil
+}
+
+// invalidBody answers 413 when the body exceeds the limit of the server and 400 otherwise
+func (h *Handler) invalidBody(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		h.writeError(w, r, http.StatusRequestEntityTooLarge, "body exceeds "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes")
+		return
+	}
+	h.writeError(w, r, http.StatusBadRequest, "invalid body")
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, r *http.Request, code int, msg string) {
 	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	json.NewEncoder(w).Encode(tracing.ErrorBody(r.Context(), msg))
 }
 
 func parseMonthYear(s string) (time.Time, error) {
 	// expected MM-YYYY
-	return time.Parse("01-2006", s)
+	return time.Parse(monthYearLayout, s)
 }
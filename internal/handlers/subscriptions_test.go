@@ -2,31 +2,195 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/effectivemobile/subscriptions/internal/auth"
 	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/effectivemobile/subscriptions/internal/store"
+	"github.com/effectivemobile/subscriptions/internal/tracing"
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
 // mock repository
 type mockRepo struct {
-	createFn     func(sub *model.Subscription) error
-	listFn       func(filter map[string]interface{}) ([]model.Subscription, error)
-	aggregateFn   func(userID *uuid.UUID, serviceName *string, from, to time.Time) (int64, error)
+	createFn    func(sub *model.Subscription) error
+	updateFn    func(sub *model.Subscription, priceFrom time.Time) error
+	listFn      func(f store.Filter) ([]model.Subscription, error)
+	aggregateFn func(f store.Filter, from, to time.Time, currency string) (model.Money, error)
+	forecastFn  func(f store.Filter, from time.Time, months int, currency string) ([]model.Money, error)
+	renewalsFn  func(userID *uuid.UUID, from, to time.Time) ([]model.Renewal, error)
+	pauseFn     func(pause *model.Pause) error
+	resumeFn    func(subscriptionID uuid.UUID, month time.Time) error
+	getFn       func(id uuid.UUID) (*model.Subscription, error)
+	membersFn   func(subscriptionID uuid.UUID, split string, members []model.Member) error
+	settleFn    func(userID *uuid.UUID, from, to time.Time, currency string) ([]model.Debt, error)
+	byTagFn     func(f store.Filter, from, to time.Time, currency string) ([]model.CategoryTotal, error)
+	budgetsFn   func(userID uuid.UUID) ([]model.Budget, error)
+	findSvcFn   func(name string) (*model.Service, error)
+	searchFn    func(query string, limit int) ([]model.Service, error)
+	keyFn       func(k *model.APIKey) error
+	revokeFn    func(id uuid.UUID) error
+	calTokens   map[string]uuid.UUID
 }
 
-func (m *mockRepo) Create(sub *model.Subscription) error { if m.createFn != nil { return m.createFn(sub) } return nil }
-func (m *mockRepo) Get(id uuid.UUID) (*model.Subscription, error) { return nil, nil }
-func (m *mockRepo) Update(sub *model.Subscription) error { return nil }
+func (m *mockRepo) Create(sub *model.Subscription) error {
+	if m.createFn != nil {
+		return m.createFn(sub)
+	}
+	return nil
+}
+func (m *mockRepo) Get(id uuid.UUID) (*model.Subscription, error) {
+	if m.getFn != nil {
+		return m.getFn(id)
+	}
+	return nil, nil
+}
+func (m *mockRepo) Update(sub *model.Subscription, priceFrom time.Time) error {
+	if m.updateFn != nil {
+		return m.updateFn(sub, priceFrom)
+	}
+	return nil
+}
 func (m *mockRepo) Delete(id uuid.UUID) error { return nil }
-func (m *mockRepo) List(filter map[string]interface{}) ([]model.Subscription, error) { if m.listFn != nil { return m.listFn(filter) } return nil, nil }
-func (m *mockRepo) AggregateSum(userID *uuid.UUID, serviceName *string, from, to time.Time) (int64, error) { if m.aggregateFn != nil { return m.aggregateFn(userID, serviceName, from, to) } return 0, nil }
+func (m *mockRepo) List(f store.Filter) ([]model.Subscription, error) {
+	if m.listFn != nil {
+		return m.listFn(f)
+	}
+	return nil, nil
+}
+func (m *mockRepo) AggregateSum(f store.Filter, from, to time.Time, currency string) (model.Money, error) {
+	if m.aggregateFn != nil {
+		return m.aggregateFn(f, from, to, currency)
+	}
+	return 0, nil
+}
+func (m *mockRepo) ForecastSum(f store.Filter, from time.Time, months int, currency string) ([]model.Money, error) {
+	if m.forecastFn != nil {
+		return m.forecastFn(f, from, months, currency)
+	}
+	return nil, nil
+}
+func (m *mockRepo) Renewals(userID *uuid.UUID, from, to time.Time) ([]model.Renewal, error) {
+	if m.renewalsFn != nil {
+		return m.renewalsFn(userID, from, to)
+	}
+	return nil, nil
+}
+func (m *mockRepo) Pause(pause *model.Pause) error {
+	if m.pauseFn != nil {
+		return m.pauseFn(pause)
+	}
+	return nil
+}
+func (m *mockRepo) Resume(subscriptionID uuid.UUID, month time.Time) error {
+	if m.resumeFn != nil {
+		return m.resumeFn(subscriptionID, month)
+	}
+	return nil
+}
+func (m *mockRepo) ListPauses(subscriptionID uuid.UUID) ([]model.Pause, error)      { return nil, nil }
+func (m *mockRepo) ListPrices(subscriptionID uuid.UUID) ([]model.PricePoint, error) { return nil, nil }
+func (m *mockRepo) SetMembers(subscriptionID uuid.UUID, split string, members []model.Member) error {
+	if m.membersFn != nil {
+		return m.membersFn(subscriptionID, split, members)
+	}
+	return nil
+}
+func (m *mockRepo) ListMembers(subscriptionID uuid.UUID) ([]model.Member, error) { return nil, nil }
+func (m *mockRepo) AggregateByTag(f store.Filter, from, to time.Time, currency string) ([]model.CategoryTotal, error) {
+	if m.byTagFn != nil {
+		return m.byTagFn(f, from, to, currency)
+	}
+	return nil, nil
+}
+func (m *mockRepo) CreateBudget(b *model.Budget) error { return nil }
+func (m *mockRepo) ListBudgets(userID uuid.UUID) ([]model.Budget, error) {
+	if m.budgetsFn != nil {
+		return m.budgetsFn(userID)
+	}
+	return nil, nil
+}
+func (m *mockRepo) DeleteBudget(id uuid.UUID) error { return nil }
+func (m *mockRepo) FindService(name string) (*model.Service, error) {
+	if m.findSvcFn != nil {
+		return m.findSvcFn(name)
+	}
+	return nil, nil
+}
+func (m *mockRepo) SearchServices(query string, limit int) ([]model.Service, error) {
+	if m.searchFn != nil {
+		return m.searchFn(query, limit)
+	}
+	return nil, nil
+}
+func (m *mockRepo) CreateService(svc *model.Service) error { return nil }
+func (m *mockRepo) AddAliases(serviceID uuid.UUID, aliases []string) (*model.Service, error) {
+	return nil, nil
+}
+func (m *mockRepo) CreateAPIKey(k *model.APIKey) error {
+	if m.keyFn != nil {
+		return m.keyFn(k)
+	}
+	return nil
+}
+func (m *mockRepo) ListAPIKeys() ([]model.APIKey, error) { return nil, nil }
+func (m *mockRepo) RevokeAPIKey(id uuid.UUID) error {
+	if m.revokeFn != nil {
+		return m.revokeFn(id)
+	}
+	return nil
+}
+func (m *mockRepo) RotateAPIKey(id uuid.UUID, prefix string, hash []byte) (*model.APIKey, error) {
+	return &model.APIKey{ID: id, Prefix: prefix, Hash: hash}, nil
+}
+func (m *mockRepo) FindAPIKey(prefix string) (*model.APIKey, error)  { return nil, sql.ErrNoRows }
+func (m *mockRepo) TouchAPIKey(id uuid.UUID, at time.Time) error     { return nil }
+func (m *mockRepo) WithContext(ctx context.Context) store.Repository { return m }
+func (m *mockRepo) SetCalendarToken(userID uuid.UUID, hash []byte) error {
+	if m.calTokens == nil {
+		m.calTokens = map[string]uuid.UUID{}
+	}
+	for h, id := range m.calTokens {
+		if id == userID {
+			delete(m.calTokens, h)
+		}
+	}
+	m.calTokens[string(hash)] = userID
+	return nil
+}
+func (m *mockRepo) DeleteCalendarToken(userID uuid.UUID) error {
+	for h, id := range m.calTokens {
+		if id == userID {
+			delete(m.calTokens, h)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+func (m *mockRepo) FindCalendarToken(hash []byte) (uuid.UUID, error) {
+	if id, ok := m.calTokens[string(hash)]; ok {
+		return id, nil
+	}
+	return uuid.Nil, sql.ErrNoRows
+}
+func (m *mockRepo) Settlement(userID *uuid.UUID, from, to time.Time, currency string) ([]model.Debt, error) {
+	if m.settleFn != nil {
+		return m.settleFn(userID, from, to, currency)
+	}
+	return nil, nil
+}
 
 func readBody(t *testing.T, r io.Reader, v interface{}) {
 	if err := json.NewDecoder(r).Decode(v); err != nil {
@@ -48,9 +212,9 @@ func TestCreateHandler_Valid(t *testing.T) {
 
 	body := map[string]interface{}{
 		"service_name": "Yandex Plus",
-		"price": 400,
-		"user_id": uuid.New().String(),
-		"start_date": "07-2025",
+		"price":        400,
+		"user_id":      uuid.New().String(),
+		"start_date":   "07-2025",
 	}
 	b, _ := json.Marshal(body)
 	req := httptest.NewRequest(http.MethodPost, "/subscriptions/", bytes.NewReader(b))
@@ -63,15 +227,50 @@ func TestCreateHandler_Valid(t *testing.T) {
 	}
 	var got model.Subscription
 	readBody(t, rr.Body, &got)
-	if got.ServiceName != "Yandex Plus" || got.Price != 400 {
+	if got.ServiceName != "Yandex Plus" || got.Price != 40000 {
 		t.Fatalf("unexpected body: %+v", got)
 	}
 }
 
+func TestCreateHandler_Tags(t *testing.T) {
+	var tags []string
+	mr := &mockRepo{}
+	mr.createFn = func(sub *model.Subscription) error {
+		tags = sub.Tags
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	body := `{"service_name":"Yandex Plus","price":400,"user_id":"` + uuid.NewString() + `","start_date":"07-2025","tags":["Music","video"," music "]}`
+	rr := httptest.NewRecorder()
+	h.Create(rr, httptest.NewRequest(http.MethodPost, "/subscriptions/", strings.NewReader(body)))
+	if rr.Code != http.StatusCreated || len(tags) != 2 || tags[0] != "music" || tags[1] != "video" {
+		t.Fatalf("expected normalized unique tags, got %d %v", rr.Code, tags)
+	}
+}
+
+func TestCreateHandler_CurrencyCase(t *testing.T) {
+	var currency string
+	mr := &mockRepo{}
+	mr.createFn = func(sub *model.Subscription) error {
+		currency = sub.Currency
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	// currencies are accepted in any case, like the currency parameter
+	body := `{"service_name":"Yandex Plus","price":400,"user_id":"` + uuid.NewString() + `","start_date":"07-2025","currency":"usd"}`
+	rr := httptest.NewRecorder()
+	h.Create(rr, httptest.NewRequest(http.MethodPost, "/subscriptions/", strings.NewReader(body)))
+	if rr.Code != http.StatusCreated || currency != "USD" {
+		t.Fatalf("expected the currency upper-cased, got %d %q", rr.Code, currency)
+	}
+}
+
 func TestAggregateHandler(t *testing.T) {
 	mr := &mockRepo{}
-	mr.aggregateFn = func(userID *uuid.UUID, serviceName *string, from, to time.Time) (int64, error) {
-		return 1200, nil
+	mr.aggregateFn = func(f store.Filter, from, to time.Time, currency string) (model.Money, error) {
+		return 1200050, nil
 	}
 	lg := logrus.New()
 	h := NewHandler(mr, lg)
@@ -84,17 +283,83 @@ func TestAggregateHandler(t *testing.T) {
 	if rr.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d", rr.Code)
 	}
-	var res map[string]int64
-	readBody(t, rr.Body, &res)
-	if res["total"] != 1200 {
-		t.Fatalf("unexpected total: %d", res["total"])
+	if got := strings.TrimSpace(rr.Body.String()); got != `{"total":12000.50,"currency":"RUB"}` {
+		t.Fatalf("unexpected body: %s", got)
+	}
+}
+
+func TestAggregateHandler_Currency(t *testing.T) {
+	var got string
+	mr := &mockRepo{}
+	mr.aggregateFn = func(f store.Filter, from, to time.Time, currency string) (model.Money, error) {
+		got = currency
+		if currency != "RUB" {
+			return 0, fmt.Errorf("%w for %s in 07-2025", store.ErrNoRate, currency)
+		}
+		return 0, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/aggregate?from=07-2025&to=09-2025", nil)
+	rr := httptest.NewRecorder()
+	h.Aggregate(rr, req)
+	if rr.Code != http.StatusOK || got != "RUB" {
+		t.Fatalf("expected the default currency RUB, got %d %q", rr.Code, got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/subscriptions/aggregate?from=07-2025&to=09-2025&currency=usd", nil)
+	rr = httptest.NewRecorder()
+	h.Aggregate(rr, req)
+	if got != "USD" {
+		t.Fatalf("expected USD, got %s", got)
+	}
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 without rates, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/subscriptions/aggregate?from=07-2025&to=09-2025&currency=XXXX", nil)
+	rr = httptest.NewRecorder()
+	h.Aggregate(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid currency, got %d", rr.Code)
+	}
+}
+
+func TestAggregateHandler_GroupByCategory(t *testing.T) {
+	mr := &mockRepo{}
+	mr.aggregateFn = func(f store.Filter, from, to time.Time, currency string) (model.Money, error) {
+		return 150000, nil
+	}
+	music := "music"
+	mr.byTagFn = func(f store.Filter, from, to time.Time, currency string) ([]model.CategoryTotal, error) {
+		return []model.CategoryTotal{{Category: &music, Total: 100000}, {Total: 50000}}, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/aggregate?from=07-2025&to=09-2025&group_by=category", nil)
+	rr := httptest.NewRecorder()
+
+	h.Aggregate(rr, req)
+
+	want := `{"total":1500.00,"currency":"RUB","categories":[{"category":"music","total":1000.00},{"category":null,"total":500.00}]}`
+	if got := strings.TrimSpace(rr.Body.String()); rr.Code != http.StatusOK || got != want {
+		t.Fatalf("unexpected response %d: %s", rr.Code, got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/subscriptions/aggregate?from=07-2025&to=09-2025&group_by=service", nil)
+	rr = httptest.NewRecorder()
+	h.Aggregate(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown group_by, got %d", rr.Code)
 	}
 }
 
 func TestListHandler(t *testing.T) {
-	sample := model.Subscription{ServiceName: "A", Price: 100}
+	sample := model.Subscription{ServiceName: "A", Price: 10000}
 	mr := &mockRepo{}
-	mr.listFn = func(filter map[string]interface{}) ([]model.Subscription, error) { return []model.Subscription{sample}, nil }
+	mr.listFn = func(f store.Filter) ([]model.Subscription, error) {
+		return []model.Subscription{sample}, nil
+	}
 	lg := logrus.New()
 	h := NewHandler(mr, lg)
 
@@ -112,3 +377,514 @@ func TestListHandler(t *testing.T) {
 		t.Fatalf("unexpected list response: %+v", arr)
 	}
 }
+
+func TestListHandler_TagFilter(t *testing.T) {
+	var tags []string
+	mr := &mockRepo{}
+	mr.listFn = func(f store.Filter) ([]model.Subscription, error) {
+		tags = f.Tags
+		return nil, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	rr := httptest.NewRecorder()
+	h.List(rr, httptest.NewRequest(http.MethodGet, "/subscriptions/?tag=%20Music", nil))
+	if rr.Code != http.StatusOK || len(tags) != 1 || tags[0] != "music" {
+		t.Fatalf("expected normalized tag filter, got %d %v", rr.Code, tags)
+	}
+}
+
+func TestFilterParams_DefaultMatch(t *testing.T) {
+	var got store.MatchMode
+	mr := &mockRepo{}
+	mr.listFn = func(f store.Filter) ([]model.Subscription, error) {
+		got = f.Match
+		return []model.Subscription{}, nil
+	}
+	mr.aggregateFn = func(f store.Filter, from, to time.Time, currency string) (model.Money, error) {
+		got = f.Match
+		return 0, nil
+	}
+	mr.forecastFn = func(f store.Filter, from time.Time, months int, currency string) ([]model.Money, error) {
+		got = f.Match
+		return make([]model.Money, months), nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	cases := []struct {
+		handler http.HandlerFunc
+		url     string
+		want    store.MatchMode
+	}{
+		{h.List, "/subscriptions/?service_name=Netflix", store.MatchExact},
+		{h.List, "/subscriptions/?service_name=flix&match=contains", store.MatchContains},
+		{h.Aggregate, "/subscriptions/aggregate?service_name=Netflix&from=01-2025&to=02-2025", store.MatchExact},
+		{h.Forecast, "/subscriptions/forecast?service_name=Netflix&months=2", store.MatchExact},
+	}
+	for _, c := range cases {
+		got = ""
+		rr := httptest.NewRecorder()
+		c.handler(rr, httptest.NewRequest(http.MethodGet, c.url, nil))
+		if rr.Code != http.StatusOK || got != c.want {
+			t.Fatalf("%s: expected match %q, got %q (%d)", c.url, c.want, got, rr.Code)
+		}
+	}
+}
+
+func TestListHandler_Query(t *testing.T) {
+	mr := &mockRepo{}
+	mr.listFn = func(f store.Filter) ([]model.Subscription, error) {
+		if f.ServiceName == nil || *f.ServiceName != "netflix" || *f.PriceMin != 30000 || f.ExcludeTags[0] != "work" {
+			t.Fatalf("unexpected filter: %+v", f)
+		}
+		return []model.Subscription{}, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	q := url.QueryEscape("service:netflix price>=300 active:2025-03 -tag:work")
+	rr := httptest.NewRecorder()
+	h.List(rr, httptest.NewRequest(http.MethodGet, "/subscriptions/?q="+q, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	h.List(rr, httptest.NewRequest(http.MethodGet, "/subscriptions/?q="+url.QueryEscape("service:netflix prize>3"), nil))
+	var body struct {
+		Error    string `json:"error"`
+		Position int    `json:"position"`
+	}
+	readBody(t, rr.Body, &body)
+	if rr.Code != http.StatusBadRequest || body.Position != 17 {
+		t.Fatalf("expected 400 at position 17, got %d: %+v", rr.Code, body)
+	}
+}
+
+func TestForecastHandler(t *testing.T) {
+	mr := &mockRepo{}
+	mr.forecastFn = func(f store.Filter, from time.Time, months int, currency string) ([]model.Money, error) {
+		if months != 3 || from.Day() != 1 {
+			t.Fatalf("unexpected forecast args: from=%v months=%d", from, months)
+		}
+		return []model.Money{500, 500, 100}, nil
+	}
+	lg := logrus.New()
+	h := NewHandler(mr, lg)
+
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/forecast?months=3", nil)
+	rr := httptest.NewRecorder()
+
+	h.Forecast(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var res []model.MonthTotal
+	readBody(t, rr.Body, &res)
+	if len(res) != 3 || res[2].Total != 100 {
+		t.Fatalf("unexpected forecast response: %+v", res)
+	}
+	if want := time.Now().UTC().Format("01-2006"); res[0].Month != want {
+		t.Fatalf("expected first month %s, got %s", want, res[0].Month)
+	}
+}
+
+func TestForecastHandler_InvalidMonths(t *testing.T) {
+	h := NewHandler(&mockRepo{}, logrus.New())
+	for _, q := range []string{"", "0", "abc", "1000"} {
+		req := httptest.NewRequest(http.MethodGet, "/subscriptions/forecast?months="+q, nil)
+		rr := httptest.NewRecorder()
+		h.Forecast(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("months=%q: expected 400, got %d", q, rr.Code)
+		}
+	}
+}
+
+func TestRenewalsHandler(t *testing.T) {
+	first := time.Date(2025, 7, 3, 0, 0, 0, 0, time.UTC)
+	second := time.Date(2025, 7, 10, 0, 0, 0, 0, time.UTC)
+	mr := &mockRepo{}
+	mr.renewalsFn = func(userID *uuid.UUID, from, to time.Time) ([]model.Renewal, error) {
+		if to.Sub(from) != 7*24*time.Hour {
+			t.Fatalf("unexpected window: %v - %v", from, to)
+		}
+		return []model.Renewal{{RenewalDate: first}, {RenewalDate: second}}, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/renewals?days=7&order=desc", nil)
+	rr := httptest.NewRecorder()
+
+	h.Renewals(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var res []model.Renewal
+	readBody(t, rr.Body, &res)
+	if len(res) != 2 || !res[0].RenewalDate.Equal(second) {
+		t.Fatalf("unexpected renewals response: %+v", res)
+	}
+}
+
+func TestCalendarHandler(t *testing.T) {
+	uid := uuid.New()
+	mr := &mockRepo{}
+	mr.listFn = func(f store.Filter) ([]model.Subscription, error) {
+		if f.UserID == nil || *f.UserID != uid {
+			t.Fatalf("expected calendar scoped to user, got filter %+v", f)
+		}
+		return []model.Subscription{{ID: uuid.New(), ServiceName: "A", Price: 100, StartDate: time.Now()}}, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/calendar.ics?user_id="+uid.String(), nil)
+	rr := httptest.NewRecorder()
+
+	h.Calendar(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/calendar") {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+	if !strings.Contains(rr.Body.String(), "BEGIN:VEVENT") {
+		t.Fatalf("expected an event in calendar:\n%s", rr.Body.String())
+	}
+}
+
+func TestCalendarFeed(t *testing.T) {
+	uid := uuid.New()
+	mr := &mockRepo{}
+	mr.listFn = func(f store.Filter) ([]model.Subscription, error) {
+		if f.UserID == nil || *f.UserID != uid {
+			t.Fatalf("expected the feed of the token's user, got filter %+v", f)
+		}
+		return []model.Subscription{{ID: uuid.New(), ServiceName: "A", Price: 100, StartDate: time.Now()}}, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	// the user gets the URL with their credentials, the calendar app fetches it without
+	req := httptest.NewRequest(http.MethodPost, "/subscriptions/calendar-token", nil)
+	req = req.WithContext(auth.WithPrincipal(req.Context(), &auth.Principal{UserID: uid}))
+	rr := httptest.NewRecorder()
+	h.CreateCalendarToken(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var tok model.CalendarToken
+	readBody(t, rr.Body, &tok)
+
+	rr = httptest.NewRecorder()
+	h.CalendarFeed(rr, httptest.NewRequest(http.MethodGet, tok.URL, nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "BEGIN:VEVENT") {
+		t.Fatalf("expected the feed, got %d:\n%s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/subscriptions/calendar-token", nil)
+	req = req.WithContext(auth.WithPrincipal(req.Context(), &auth.Principal{UserID: uid}))
+	rr = httptest.NewRecorder()
+	h.RevokeCalendarToken(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+	for _, u := range []string{tok.URL, "/calendar.ics?token=guess", "/calendar.ics"} {
+		rr = httptest.NewRecorder()
+		h.CalendarFeed(rr, httptest.NewRequest(http.MethodGet, u, nil))
+		if rr.Code != http.StatusNotFound && rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected the feed to be refused, got %d", u, rr.Code)
+		}
+	}
+}
+
+func withURLParam(req *http.Request, key, value string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add(key, value)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestPauseHandler(t *testing.T) {
+	id := uuid.New()
+	mr := &mockRepo{}
+	mr.pauseFn = func(pause *model.Pause) error {
+		if pause.SubscriptionID != id || pause.StartDate.Month() != time.August || pause.EndDate == nil || pause.EndDate.Month() != time.October {
+			t.Fatalf("unexpected pause: %+v", pause)
+		}
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	b, _ := json.Marshal(map[string]string{"from": "08-2025", "to": "10-2025"})
+	req := withURLParam(httptest.NewRequest(http.MethodPost, "/subscriptions/"+id.String()+"/pause", bytes.NewReader(b)), "id", id.String())
+	rr := httptest.NewRecorder()
+
+	h.Pause(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rr.Code)
+	}
+}
+
+func TestPauseHandler_Overlap(t *testing.T) {
+	id := uuid.New()
+	mr := &mockRepo{}
+	mr.pauseFn = func(pause *model.Pause) error { return store.ErrPauseOverlap }
+	h := NewHandler(mr, logrus.New())
+
+	req := withURLParam(httptest.NewRequest(http.MethodPost, "/subscriptions/"+id.String()+"/pause", nil), "id", id.String())
+	rr := httptest.NewRecorder()
+
+	h.Pause(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", rr.Code)
+	}
+}
+
+func TestResumeHandler_NotPaused(t *testing.T) {
+	id := uuid.New()
+	mr := &mockRepo{}
+	mr.resumeFn = func(subscriptionID uuid.UUID, month time.Time) error { return store.ErrNotPaused }
+	h := NewHandler(mr, logrus.New())
+
+	req := withURLParam(httptest.NewRequest(http.MethodPost, "/subscriptions/"+id.String()+"/resume", nil), "id", id.String())
+	rr := httptest.NewRecorder()
+
+	h.Resume(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", rr.Code)
+	}
+}
+
+func TestResumeHandler_NotFound(t *testing.T) {
+	id := uuid.New()
+	mr := &mockRepo{}
+	mr.getFn = func(uuid.UUID) (*model.Subscription, error) { return nil, sql.ErrNoRows }
+	mr.resumeFn = func(subscriptionID uuid.UUID, month time.Time) error { return store.ErrNotPaused }
+	h := NewHandler(mr, logrus.New())
+
+	req := withURLParam(httptest.NewRequest(http.MethodPost, "/subscriptions/"+id.String()+"/resume", nil), "id", id.String())
+	rr := httptest.NewRecorder()
+
+	h.Resume(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown subscription, got %d", rr.Code)
+	}
+}
+
+func TestUpdateHandler_PriceEffectiveFrom(t *testing.T) {
+	id := uuid.New()
+	mr := &mockRepo{}
+	mr.updateFn = func(sub *model.Subscription, priceFrom time.Time) error {
+		if sub.ID != id || sub.Price != 49999 {
+			t.Fatalf("unexpected subscription: %+v", sub)
+		}
+		if !priceFrom.Equal(time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("unexpected price_effective_from: %v", priceFrom)
+		}
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	body := map[string]interface{}{
+		"service_name":         "Yandex Plus",
+		"price":                "499.99",
+		"user_id":              uuid.New().String(),
+		"start_date":           "07-2025",
+		"price_effective_from": "09-2025",
+	}
+	b, _ := json.Marshal(body)
+	req := withURLParam(httptest.NewRequest(http.MethodPut, "/subscriptions/"+id.String(), bytes.NewReader(b)), "id", id.String())
+	rr := httptest.NewRecorder()
+
+	h.Update(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+}
+
+func TestUpdateHandler_PriceAfterEnd(t *testing.T) {
+	id := uuid.New()
+	var got time.Time
+	mr := &mockRepo{}
+	mr.updateFn = func(sub *model.Subscription, priceFrom time.Time) error {
+		got = priceFrom
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+	update := func(extra string) *httptest.ResponseRecorder {
+		body := `{"service_name":"Netflix","price":100,"user_id":"` + uuid.NewString() + `","start_date":"01-2025","end_date":"03-2025"` + extra + `}`
+		rr := httptest.NewRecorder()
+		h.Update(rr, withURLParam(httptest.NewRequest(http.MethodPut, "/subscriptions/"+id.String(), strings.NewReader(body)), "id", id.String()))
+		return rr
+	}
+
+	// the price of an ended subscription changes in its last month, where spend still reads it
+	if rr := update(""); rr.Code != http.StatusOK || !got.Equal(time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the price to change from the end month, got %d %v", rr.Code, got)
+	}
+	if rr := update(`,"price_effective_from":"04-2025"`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a price change after the end, got %d", rr.Code)
+	}
+}
+
+func TestPatchHandler(t *testing.T) {
+	id, uid := uuid.New(), uuid.New()
+	end := time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)
+	mr := &mockRepo{}
+	mr.getFn = func(uuid.UUID) (*model.Subscription, error) {
+		return &model.Subscription{ID: id, ServiceName: "Yandex Plus", Price: 39900, UserID: uid, Currency: "RUB",
+			StartDate: time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC), EndDate: &end, BillingDay: 15, Tags: []string{"music"}}, nil
+	}
+	mr.updateFn = func(sub *model.Subscription, priceFrom time.Time) error {
+		if sub.ID != id || sub.Price != 49900 || sub.ServiceName != "Yandex Plus" || sub.UserID != uid || sub.BillingDay != 15 ||
+			sub.EndDate != nil || !sub.StartDate.Equal(time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)) || len(sub.Tags) != 1 {
+			t.Fatalf("expected the price changed and the end date removed, got %+v", sub)
+		}
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	body := `{"price": 499, "end_date": null}`
+	req := withURLParam(httptest.NewRequest(http.MethodPatch, "/subscriptions/"+id.String(), strings.NewReader(body)), "id", id.String())
+	rr := httptest.NewRecorder()
+	h.Patch(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req = withURLParam(httptest.NewRequest(http.MethodPatch, "/subscriptions/"+id.String(), strings.NewReader(`{"billing_day": 40}`)), "id", id.String())
+	rr = httptest.NewRecorder()
+	h.Patch(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid field, got %d", rr.Code)
+	}
+}
+
+func TestUpdateHandler_NotFound(t *testing.T) {
+	mr := &mockRepo{}
+	mr.getFn = func(uuid.UUID) (*model.Subscription, error) {
+		return nil, sql.ErrNoRows
+	}
+	mr.updateFn = func(*model.Subscription, time.Time) error {
+		t.Fatal("update of a missing subscription")
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+	id := uuid.NewString()
+
+	body := `{"service_name":"Netflix","price":100,"user_id":"` + uuid.NewString() + `","start_date":"01-2025"}`
+	rr := httptest.NewRecorder()
+	h.Update(rr, withURLParam(httptest.NewRequest(http.MethodPut, "/subscriptions/"+id, strings.NewReader(body)), "id", id))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("update: expected 404, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	h.Patch(rr, withURLParam(httptest.NewRequest(http.MethodPatch, "/subscriptions/"+id, strings.NewReader(`{"price":100}`)), "id", id))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("patch: expected 404, got %d", rr.Code)
+	}
+}
+
+func TestSetMembersHandler(t *testing.T) {
+	id, owner, member := uuid.New(), uuid.New(), uuid.New()
+	mr := &mockRepo{}
+	mr.getFn = func(uuid.UUID) (*model.Subscription, error) {
+		return &model.Subscription{ID: id, UserID: owner}, nil
+	}
+	called := false
+	mr.membersFn = func(subscriptionID uuid.UUID, split string, members []model.Member) error {
+		called = true
+		if split != model.SplitPercent || len(members) != 1 || *members[0].Percent != 40 {
+			t.Fatalf("unexpected members: %s %+v", split, members)
+		}
+		return nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	body := `{"split":"percent","members":[{"user_id":"` + member.String() + `","percent":40}]}`
+	req := withURLParam(httptest.NewRequest(http.MethodPut, "/subscriptions/"+id.String()+"/members", strings.NewReader(body)), "id", id.String())
+	rr := httptest.NewRecorder()
+
+	h.SetMembers(rr, req)
+
+	if rr.Code != http.StatusOK || !called {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// the owner cannot share with themselves and percents need a value
+	for _, body := range []string{
+		`{"split":"percent","members":[{"user_id":"` + owner.String() + `","percent":40}]}`,
+		`{"split":"percent","members":[{"user_id":"` + member.String() + `"}]}`,
+		`{"split":"equal","members":[{"user_id":"` + member.String() + `","amount":100}]}`,
+	} {
+		req := withURLParam(httptest.NewRequest(http.MethodPut, "/subscriptions/"+id.String()+"/members", strings.NewReader(body)), "id", id.String())
+		rr := httptest.NewRecorder()
+		h.SetMembers(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, rr.Code)
+		}
+	}
+}
+
+func TestSettlementHandler(t *testing.T) {
+	from, to := uuid.New(), uuid.New()
+	mr := &mockRepo{}
+	mr.settleFn = func(userID *uuid.UUID, f, tt time.Time, currency string) ([]model.Debt, error) {
+		if userID != nil || currency != "RUB" || !tt.Equal(time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("unexpected args: %v %v %s", userID, tt, currency)
+		}
+		return []model.Debt{{From: from, To: to, Amount: 15000, Currency: currency}}, nil
+	}
+	h := NewHandler(mr, logrus.New())
+
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/settlement?from=01-2025&to=03-2025", nil)
+	rr := httptest.NewRecorder()
+
+	h.Settlement(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var res []model.Debt
+	readBody(t, rr.Body, &res)
+	if len(res) != 1 || res[0].From != from || res[0].Amount != 15000 {
+		t.Fatalf("unexpected settlement: %+v", res)
+	}
+}
+
+func TestWriteError_TraceID(t *testing.T) {
+	h := NewHandler(&mockRepo{}, logrus.New())
+	tr, err := tracing.New(tracing.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/bad", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	tr.Middleware(http.HandlerFunc(h.Get)).ServeHTTP(rr, req)
+
+	var body map[string]string
+	json.NewDecoder(rr.Body).Decode(&body)
+	if rr.Code != http.StatusBadRequest || body["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("expected the trace id in the error, got %d %v", rr.Code, body)
+	}
+}
+
+func TestCreateHandler_BodyTooLarge(t *testing.T) {
+	h := NewHandler(&mockRepo{}, logrus.New())
+	body := `{"service_name":"` + strings.Repeat("x", 2048) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/subscriptions/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	req.Body = http.MaxBytesReader(rr, req.Body, 1024)
+
+	h.Create(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
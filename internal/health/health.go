@@ -0,0 +1,117 @@
+// Package health serves the liveness, readiness and version endpoints of the service.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/version"
+	"github.com/sirupsen/logrus"
+)
+
+// Check reports an error when a dependency of the service is not usable
+type Check func(ctx context.Context) error
+
+// Checker runs the readiness checks, each bounded by a timeout
+type Checker struct {
+	timeout  time.Duration
+	log      logrus.FieldLogger
+	names    []string
+	checks   map[string]Check
+	draining atomic.Bool
+}
+
+// NewChecker returns a Checker logging the errors of failed checks to log,
+// which may be nil
+func NewChecker(timeout time.Duration, log logrus.FieldLogger) *Checker {
+	return &Checker{timeout: timeout, log: log, checks: map[string]Check{}}
+}
+
+// Add registers a readiness check under name
+func (c *Checker) Add(name string, check Check) {
+	c.names = append(c.names, name)
+	sort.Strings(c.names)
+	c.checks[name] = check
+}
+
+// Status of the service and of each check
+type Status struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Run runs all checks concurrently and reports whether all passed; the errors
+// are only logged, the endpoint is public and they may reveal the database
+func (c *Checker) Run(ctx context.Context) (Status, bool) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	res := Status{Status: "ok", Checks: make(map[string]string, len(c.names))}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	ok := true
+	for _, name := range c.names {
+		name, check := name, c.checks[name]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := "ok"
+			if err := check(ctx); err != nil {
+				if c.log != nil {
+					c.log.Warnf("readiness check %s failed: %v", name, err)
+				}
+				msg = "unavailable"
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			res.Checks[name] = msg
+			if msg != "ok" {
+				ok = false
+			}
+		}()
+	}
+	wg.Wait()
+	if !ok {
+		res.Status = "unavailable"
+	}
+	return res, ok
+}
+
+// Drain makes the service report not ready from now on, so that load
+// balancers stop sending it requests before it shuts down
+func (c *Checker) Drain() {
+	c.draining.Store(true)
+}
+
+// Ready answers 200 when every check passes and 503 otherwise or once draining
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	res, ok := Status{Status: "draining"}, false
+	if !c.draining.Load() {
+		res, ok = c.Run(r.Context())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// Live answers 200 as long as the process serves requests
+func Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(Status{Status: "ok"})
+}
+
+// Version returns the build information of the binary
+func Version(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version.Get())
+}
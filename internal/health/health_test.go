@@ -0,0 +1,91 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestChecker_Ready(t *testing.T) {
+	var logs bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&logs)
+	c := NewChecker(50*time.Millisecond, log)
+	c.Add("db", func(ctx context.Context) error { return nil })
+
+	rr := httptest.NewRecorder()
+	c.Ready(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var res Status
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || res.Status != "ok" || res.Checks["db"] != "ok" {
+		t.Fatalf("unexpected readiness: %d %+v", rr.Code, res)
+	}
+
+	c.Add("migrations", func(ctx context.Context) error { return errors.New("missing tables: budgets") })
+	// a hanging check is cut off by the timeout
+	c.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	rr = httptest.NewRecorder()
+	c.Ready(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	res = Status{}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusServiceUnavailable || res.Status != "unavailable" ||
+		res.Checks["db"] != "ok" || res.Checks["migrations"] != "unavailable" || res.Checks["slow"] != "unavailable" {
+		t.Fatalf("unexpected readiness: %d %+v", rr.Code, res)
+	}
+	// the errors are logged, never returned to the caller
+	if !strings.Contains(logs.String(), "missing tables: budgets") || strings.Contains(rr.Body.String(), "budgets") {
+		t.Fatalf("expected the error in the log only, got %q", logs.String())
+	}
+}
+
+func TestChecker_Drain(t *testing.T) {
+	c := NewChecker(50*time.Millisecond, nil)
+	c.Add("db", func(ctx context.Context) error {
+		t.Error("checks must not run while draining")
+		return nil
+	})
+	c.Drain()
+
+	rr := httptest.NewRecorder()
+	c.Ready(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var res Status
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusServiceUnavailable || res.Status != "draining" {
+		t.Fatalf("expected 503 while draining, got %d %+v", rr.Code, res)
+	}
+}
+
+func TestLiveAndVersion(t *testing.T) {
+	rr := httptest.NewRecorder()
+	Live(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	Version(rr, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var res map[string]string
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res["commit"] == "" || res["build_time"] == "" || res["go_version"] == "" {
+		t.Fatalf("unexpected version: %v", res)
+	}
+}
@@ -0,0 +1,121 @@
+// Package ical renders subscriptions as an RFC 5545 calendar.
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+)
+
+const (
+	dateLayout  = "20060102"
+	stampLayout = "20060102T150405Z"
+	// content lines longer than this many octets must be folded
+	maxLineOctets = 75
+)
+
+// Write emits a VCALENDAR with a monthly recurring event for each subscription's
+// charge date and a single event on its end_date, stamped with now
+func Write(w io.Writer, subs []model.Subscription, now time.Time) error {
+	bw := bufio.NewWriter(w)
+	stamp := now.UTC().Format(stampLayout)
+
+	writeLine(bw, "BEGIN:VCALENDAR")
+	writeLine(bw, "VERSION:2.0")
+	writeLine(bw, "PRODID:-//effectivemobile//subscriptions//EN")
+	writeLine(bw, "CALSCALE:GREGORIAN")
+	writeLine(bw, "METHOD:PUBLISH")
+	writeLine(bw, "X-WR-CALNAME:Subscriptions")
+	for _, s := range subs {
+		writeLine(bw, "BEGIN:VEVENT")
+		writeLine(bw, "UID:"+s.ID.String()+"-charge@subscriptions")
+		writeLine(bw, "DTSTAMP:"+stamp)
+		writeLine(bw, "DTSTART;VALUE=DATE:"+firstCharge(s).Format(dateLayout))
+		writeLine(bw, "RRULE:"+rrule(s))
+		writeLine(bw, "SUMMARY:"+escapeText(fmt.Sprintf("%s: %s %s", s.ServiceName, s.Price, currency(s))))
+		writeLine(bw, "TRANSP:TRANSPARENT")
+		writeLine(bw, "END:VEVENT")
+		if s.EndDate != nil {
+			writeLine(bw, "BEGIN:VEVENT")
+			writeLine(bw, "UID:"+s.ID.String()+"-end@subscriptions")
+			writeLine(bw, "DTSTAMP:"+stamp)
+			writeLine(bw, "DTSTART;VALUE=DATE:"+s.EndDate.Format(dateLayout))
+			writeLine(bw, "SUMMARY:"+escapeText(s.ServiceName+" subscription ends"))
+			writeLine(bw, "TRANSP:TRANSPARENT")
+			writeLine(bw, "END:VEVENT")
+		}
+	}
+	writeLine(bw, "END:VCALENDAR")
+	return bw.Flush()
+}
+
+func currency(s model.Subscription) string {
+	if s.Currency == "" {
+		return model.BaseCurrency
+	}
+	return s.Currency
+}
+
+func billingDay(s model.Subscription) int {
+	if s.BillingDay < 1 {
+		return 1
+	}
+	return s.BillingDay
+}
+
+// firstCharge is the billing day of the first paid month, clamped to the month length
+func firstCharge(s model.Subscription) time.Time {
+	start := s.BillingStart()
+	first := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	day := billingDay(s)
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+func rrule(s model.Subscription) string {
+	rule := "FREQ=MONTHLY;BYMONTHDAY=" + fmt.Sprint(billingDay(s))
+	if billingDay(s) > 28 {
+		// fall back to the last day in months shorter than the billing day
+		rule += ",-1;BYSETPOS=1"
+	}
+	if s.EndDate != nil {
+		// charges continue through the end month
+		until := time.Date(s.EndDate.Year(), s.EndDate.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, -1)
+		rule += ";UNTIL=" + until.Format(dateLayout)
+	}
+	return rule
+}
+
+// escapeText escapes a TEXT property value (RFC 5545 section 3.3.11)
+func escapeText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// writeLine writes a CRLF-terminated content line folded at 75 octets without
+// splitting UTF-8 sequences (RFC 5545 section 3.1)
+func writeLine(w *bufio.Writer, line string) {
+	limit := maxLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8Start(line[cut]) {
+			cut--
+		}
+		w.WriteString(line[:cut])
+		w.WriteString("\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space that counts towards the limit
+		limit = maxLineOctets - 1
+	}
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
+
+func utf8Start(b byte) bool {
+	return b&0xC0 != 0x80
+}
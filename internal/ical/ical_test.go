@@ -0,0 +1,63 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+)
+
+func TestWrite(t *testing.T) {
+	end := time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)
+	subs := []model.Subscription{
+		{
+			ID:          uuid.MustParse("60601fee-2bf1-4721-ae6f-7636e79a0cba"),
+			ServiceName: "Yandex Plus, family",
+			Price:       40000,
+			StartDate:   time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:     &end,
+			BillingDay:  31,
+		},
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, subs, time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"DTSTAMP:20250701T120000Z\r\n",
+		"DTSTART;VALUE=DATE:20250228\r\n",
+		"RRULE:FREQ=MONTHLY;BYMONTHDAY=31,-1;BYSETPOS=1;UNTIL=20251231\r\n",
+		"SUMMARY:Yandex Plus\\, family: 400.00 RUB\r\n",
+		"UID:60601fee-2bf1-4721-ae6f-7636e79a0cba-end@subscriptions\r\n",
+		"DTSTART;VALUE=DATE:20251201\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "BEGIN:VEVENT") != 2 {
+		t.Fatalf("expected charge and end events, got:\n%s", out)
+	}
+}
+
+func TestWriteLineFolding(t *testing.T) {
+	var buf bytes.Buffer
+	subs := []model.Subscription{{ServiceName: strings.Repeat("Яндекс Плюс ", 20), StartDate: time.Now()}}
+	if err := Write(&buf, subs, time.Now()); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+		if len(line) > maxLineOctets {
+			t.Fatalf("line longer than %d octets: %q", maxLineOctets, line)
+		}
+		if !strings.HasPrefix(line, " ") && !strings.Contains(line, ":") {
+			t.Fatalf("unexpected line: %q", line)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package logging configures the service log and hands each request a logger
+// carrying its fields through the context.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+// Configure sets the level of log, info when empty, and its format: text or json
+func Configure(log *logrus.Logger, level, format string) error {
+	if level != "" {
+		lvl, err := logrus.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		log.SetLevel(lvl)
+	}
+	switch format {
+	case "", "text":
+		log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	return nil
+}
+
+// requestLog is shared by the middlewares of a request, so that the fields
+// added deeper in the chain, such as the user, reach the access log line
+type requestLog struct {
+	mu    sync.Mutex
+	entry *logrus.Entry
+}
+
+type ctxKey struct{}
+
+// NewContext returns ctx carrying entry as the logger of the request
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, ctxKey{}, &requestLog{entry: entry})
+}
+
+// FromContext returns the logger of the request
+func FromContext(ctx context.Context) (*logrus.Entry, bool) {
+	rl, ok := ctx.Value(ctxKey{}).(*requestLog)
+	if !ok {
+		return nil, false
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.entry, true
+}
+
+// AddFields adds fields to the logger of the request, the later entries of the
+// request and its access log line carry them
+func AddFields(ctx context.Context, fields logrus.Fields) {
+	rl, ok := ctx.Value(ctxKey{}).(*requestLog)
+	if !ok {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.entry = rl.entry.WithFields(fields)
+}
+
+// Middleware hands the request a logger with its id, method, path and remote
+// IP and logs it once served with status, bytes written and duration; server
+// errors are logged as errors and client errors as warnings
+func Middleware(log *logrus.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ctx := NewContext(r.Context(), log.WithContext(r.Context()).WithFields(logrus.Fields{
+				"req_id":    middleware.GetReqID(r.Context()),
+				"method":    r.Method,
+				"path":      r.URL.Path,
+				"remote_ip": remoteIP(r),
+			}))
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			entry, _ := FromContext(ctx)
+			entry = entry.WithFields(logrus.Fields{
+				"status": status,
+				"bytes":  ww.BytesWritten(),
+				"dur_ms": time.Since(start).Milliseconds(),
+			})
+			switch {
+			case status >= http.StatusInternalServerError:
+				entry.Error("handled request")
+			case status >= http.StatusBadRequest:
+				entry.Warn("handled request")
+			default:
+				entry.Info("handled request")
+			}
+		})
+	}
+}
+
+// remoteIP is the address of the client, which RealIP takes from the proxy headers
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
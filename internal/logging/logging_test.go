@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&buf)
+	if err := Configure(log, "debug", "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := middleware.RequestID(Middleware(log)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddFields(r.Context(), logrus.Fields{"user": "alice"})
+		entry, ok := FromContext(r.Context())
+		if !ok {
+			t.Fatal("expected a logger in the context")
+		}
+		entry.Debug("loading")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	})))
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/42", nil)
+	req.RemoteAddr = "10.0.0.1:5123"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var line map[string]interface{}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %v", lines)
+	}
+	for _, line := range lines {
+		if line["req_id"] == "" || line["req_id"] == nil || line["user"] != "alice" || line["remote_ip"] != "10.0.0.1" {
+			t.Fatalf("expected the request fields on every line, got %v", line)
+		}
+	}
+	access := lines[1]
+	if access["status"] != float64(404) || access["bytes"] != float64(9) || access["level"] != "warning" {
+		t.Fatalf("unexpected access line: %v", access)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	log := logrus.New()
+	if err := Configure(log, "", ""); err != nil || log.GetLevel() != logrus.InfoLevel {
+		t.Fatalf("expected the defaults, got %v %v", log.GetLevel(), err)
+	}
+	if err := Configure(log, "verbose", "text"); err == nil {
+		t.Fatal("expected an unknown level to fail")
+	}
+	if err := Configure(log, "info", "xml"); err == nil {
+		t.Fatal("expected an unknown format to fail")
+	}
+}
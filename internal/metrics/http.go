@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HTTPMiddleware counts requests and observes their latency per method, chi
+// route pattern and status; requests that match no route share the route "unmatched"
+func (r *Registry) HTTPMiddleware() func(http.Handler) http.Handler {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+	latency := r.NewHistogramVec("http_request_duration_seconds", "HTTP request latency by method, route and status.", DefBuckets, "method", "route", "status")
+	r.MustRegister(requests)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
+			next.ServeHTTP(ww, req)
+			// the pattern is complete only once the router has matched the request
+			route := "unmatched"
+			if rc := chi.RouteContext(req.Context()); rc != nil && rc.RoutePattern() != "" {
+				route = rc.RoutePattern()
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			code := strconv.Itoa(status)
+			requests.WithLabelValues(req.Method, route, code).Inc()
+			latency.WithLabelValues(req.Method, route, code).Observe(time.Since(start).Seconds())
+		})
+	}
+}
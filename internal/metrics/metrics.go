@@ -0,0 +1,98 @@
+// Package metrics registers the Prometheus metrics of the service on its own
+// registry and serves them for scraping.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefBuckets are latency buckets in seconds suited to HTTP requests and queries
+var DefBuckets = prometheus.DefBuckets
+
+// Registry holds the metrics of the service along with the Go runtime and
+// process metrics
+type Registry struct {
+	*prometheus.Registry
+}
+
+func NewRegistry() *Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return &Registry{r}
+}
+
+// Handler serves the metrics for scraping
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.Registry, promhttp.HandlerOpts{Registry: r.Registry})
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	r.MustRegister(h)
+	return h
+}
+
+// DBStats exposes the connection pool statistics of a database as go_sql_*
+// metrics labelled with name
+func (r *Registry) DBStats(db *sql.DB, name string) {
+	r.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// Sample is a value of a gauge with the values of its labels
+type Sample struct {
+	Value  float64
+	Labels []string
+}
+
+// NewGaugeFunc registers a gauge read from fn on every scrape, one series per
+// sample; the gauge is left out of scrapes while fn fails
+func (r *Registry) NewGaugeFunc(name, help string, fn func() ([]Sample, error), labels ...string) {
+	r.MustRegister(&funcCollector{desc: prometheus.NewDesc(name, help, labels, nil), fn: fn})
+}
+
+type funcCollector struct {
+	desc *prometheus.Desc
+	fn   func() ([]Sample, error)
+}
+
+func (c *funcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *funcCollector) Collect(ch chan<- prometheus.Metric) {
+	samples, err := c.fn()
+	if err != nil {
+		return
+	}
+	for _, s := range samples {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, s.Value, s.Labels...)
+	}
+}
+
+// Cached returns fn computed at most once per ttl, for gauges that are
+// expensive to compute however often they are scraped; a failure is kept for
+// ttl as well, so that a failing database is not queried on every scrape
+func Cached[T any](ttl time.Duration, fn func() (T, error)) func() (T, error) {
+	var (
+		mu      sync.Mutex
+		value   T
+		err     error
+		updated time.Time
+	)
+	return func() (T, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if updated.IsZero() || time.Since(updated) >= ttl {
+			value, err = fn()
+			updated = time.Now()
+		}
+		return value, err
+	}
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	rr := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected content type %q", rr.Header().Get("Content-Type"))
+	}
+	return rr.Body.String()
+}
+
+func expectLines(t *testing.T, out string, lines ...string) {
+	t.Helper()
+	for _, l := range lines {
+		if !strings.Contains(out, l+"\n") {
+			t.Errorf("missing %q in:\n%s", l, out)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "method")
+	h.WithLabelValues("List").Observe(0.05)
+	h.WithLabelValues("List").Observe(0.5)
+	h.WithLabelValues("List").Observe(3)
+	r.NewGaugeFunc("revenue", "Revenue.", func() ([]Sample, error) {
+		return []Sample{{Value: 1.5, Labels: []string{"RUB"}}, {Value: 2, Labels: []string{"USD"}}}, nil
+	}, "currency")
+	r.NewGaugeFunc("broken", "Broken.", func() ([]Sample, error) { return nil, errors.New("db down") })
+
+	out := scrape(t, r)
+	expectLines(t, out,
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{method="List",le="0.1"} 1`,
+		`latency_seconds_bucket{method="List",le="1"} 2`,
+		`latency_seconds_bucket{method="List",le="+Inf"} 3`,
+		`latency_seconds_sum{method="List"} 3.55`,
+		"# TYPE revenue gauge",
+		`revenue{currency="RUB"} 1.5`,
+		`revenue{currency="USD"} 2`,
+		"# TYPE go_goroutines gauge",
+	)
+	if strings.Contains(out, "broken") {
+		t.Fatalf("a failing gauge must be left out:\n%s", out)
+	}
+}
+
+func TestCached(t *testing.T) {
+	calls := 0
+	fn := Cached(time.Hour, func() (int, error) {
+		calls++
+		return 42, nil
+	})
+	for i := 0; i < 3; i++ {
+		if v, err := fn(); v != 42 || err != nil {
+			t.Fatalf("unexpected result %d %v", v, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected fn to be computed once, got %d", calls)
+	}
+
+	failures := 0
+	broken := Cached(time.Hour, func() (int, error) {
+		failures++
+		return 0, errors.New("db down")
+	})
+	broken()
+	if _, err := broken(); err == nil || failures != 1 {
+		t.Fatalf("expected the failure to be cached, got %v after %d calls", err, failures)
+	}
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	reg := NewRegistry()
+	r := chi.NewRouter()
+	r.Use(reg.HTTPMiddleware())
+	r.Route("/subscriptions", func(r chi.Router) {
+		r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})
+	})
+	for _, path := range []string{"/subscriptions/1", "/subscriptions/2", "/nope"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	out := scrape(t, reg)
+	expectLines(t, out,
+		`http_requests_total{method="GET",route="/subscriptions/{id}",status="404"} 2`,
+		`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/subscriptions/{id}",status="404"} 2`,
+	)
+}
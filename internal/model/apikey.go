@@ -0,0 +1,46 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// API key scopes, admin grants all of them and manages keys
+const (
+	ScopeRead      = "read"
+	ScopeWrite     = "write"
+	ScopeAggregate = "aggregate"
+	ScopeAdmin     = "admin"
+)
+
+// Machine credential of a back-office service; only a hash of the secret is stored
+type APIKey struct {
+	ID   uuid.UUID `db:"id" json:"id"`
+	Name string    `db:"name" json:"name"`
+	// public part of the key it is looked up by
+	Prefix     string     `db:"prefix" json:"prefix"`
+	Hash       []byte     `db:"hash" json:"-"`
+	Scopes     []string   `db:"-" json:"scopes"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+}
+
+// API key request body
+type APIKeyRequest struct {
+	Name   string   `json:"name" validate:"required,max=100"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=read write aggregate admin"`
+}
+
+// Created or rotated API key with its secret, which is never shown again
+type APIKeyResponse struct {
+	*APIKey
+	Key string `json:"key"`
+}
+
+// Calendar feed token of a user with the URL to subscribe to, which is never shown again
+type CalendarToken struct {
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
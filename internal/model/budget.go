@@ -0,0 +1,36 @@
+package model
+
+import "github.com/google/uuid"
+
+// Monthly spending limit of a user, overall or for a single category (tag) or service
+type Budget struct {
+	ID          uuid.UUID `db:"id" json:"id"`
+	UserID      uuid.UUID `db:"user_id" json:"user_id"`
+	Category    *string   `db:"category" json:"category,omitempty"`
+	ServiceName *string   `db:"service_name" json:"service_name,omitempty"`
+	Amount      Money     `db:"amount" json:"amount"`
+	Currency    string    `db:"currency" json:"currency"`
+}
+
+// Budget request body, at most one of Category and ServiceName is set
+type BudgetRequest struct {
+	UserID      string  `json:"user_id" validate:"required,uuid4"`
+	Category    *string `json:"category,omitempty" validate:"omitempty,min=1,max=32"`
+	ServiceName *string `json:"service_name,omitempty" validate:"omitempty,min=1"`
+	Amount      Money   `json:"amount" validate:"required,min=1"`
+	Currency    string  `json:"currency,omitempty" validate:"omitempty,iso4217"`
+}
+
+// Actual spend against a budget in a single month (MM-YYYY)
+type BudgetMonth struct {
+	Budget
+	Month string `json:"month"`
+	Spent Money  `json:"spent"`
+	Over  bool   `json:"over"`
+}
+
+// Subscription returned by Create and Update, with the budgets it pushed over
+type SubscriptionResponse struct {
+	*Subscription
+	Overspend []BudgetMonth `json:"overspend,omitempty"`
+}
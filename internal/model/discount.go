@@ -0,0 +1,74 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Discount lowers the monthly price, either for the first Months paid months
+// or for the whole subscription; exactly one of Percent, Amount and Price is set
+type Discount struct {
+	// percent off the price
+	Percent *int `json:"percent,omitempty" validate:"omitempty,min=1,max=100"`
+	// fixed amount off the price
+	Amount *Money `json:"amount,omitempty" validate:"omitempty,min=1"`
+	// promo price replacing the price, e.g. 1 ruble for the first 3 months
+	Price  *Money `json:"price,omitempty" validate:"omitempty,min=0"`
+	Months *int   `json:"months,omitempty" validate:"omitempty,min=1"`
+}
+
+// Check reports whether exactly one kind of discount is set
+func (d *Discount) Check() error {
+	n := 0
+	for _, set := range []bool{d.Percent != nil, d.Amount != nil, d.Price != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("discount must set exactly one of percent, amount or price")
+	}
+	return nil
+}
+
+// Apply returns price after the discount for the month with the given 0-based
+// index, counted in calendar months from the first paid month
+func (d *Discount) Apply(price Money, month int) Money {
+	if d == nil || (d.Months != nil && month >= *d.Months) {
+		return price
+	}
+	switch {
+	case d.Percent != nil:
+		// the discount is rounded half up to minor units
+		return price - (price*Money(*d.Percent)+50)/100
+	case d.Amount != nil:
+		if *d.Amount >= price {
+			return 0
+		}
+		return price - *d.Amount
+	case d.Price != nil && *d.Price < price:
+		return *d.Price
+	}
+	return price
+}
+
+// Value stores the discount as JSONB
+func (d *Discount) Value() (driver.Value, error) {
+	if d == nil {
+		return nil, nil
+	}
+	return json.Marshal(d)
+}
+
+// Scan reads the discount from JSONB
+func (d *Discount) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, d)
+	case string:
+		return json.Unmarshal([]byte(v), d)
+	}
+	return fmt.Errorf("unsupported discount value %T", src)
+}
@@ -0,0 +1,42 @@
+package model
+
+import "testing"
+
+func TestDiscountApply(t *testing.T) {
+	intp := func(v int) *int { return &v }
+	moneyp := func(v Money) *Money { return &v }
+	cases := []struct {
+		name  string
+		d     *Discount
+		price Money
+		month int
+		want  Money
+	}{
+		{"none", nil, 29999, 0, 29999},
+		{"percent", &Discount{Percent: intp(20)}, 29999, 5, 23999},
+		{"amount", &Discount{Amount: moneyp(5000)}, 29999, 0, 24999},
+		{"amount above price", &Discount{Amount: moneyp(50000)}, 29999, 0, 0},
+		{"promo price", &Discount{Price: moneyp(100), Months: intp(3)}, 29999, 2, 100},
+		{"promo over", &Discount{Price: moneyp(100), Months: intp(3)}, 29999, 3, 29999},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.d.Apply(c.price, c.month); got != c.want {
+				t.Fatalf("Apply(%v, %d) = %v; want %v", c.price, c.month, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDiscountCheck(t *testing.T) {
+	p, m := 10, Money(100)
+	if err := (&Discount{Percent: &p}).Check(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := (&Discount{}).Check(); err == nil {
+		t.Fatalf("expected error for empty discount")
+	}
+	if err := (&Discount{Percent: &p, Amount: &m}).Check(); err == nil {
+		t.Fatalf("expected error for two kinds")
+	}
+}
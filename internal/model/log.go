@@ -0,0 +1,6 @@
+package model
+
+// LogLevel is the level of the service log, one of trace, debug, info, warn, error, fatal and panic
+type LogLevel struct {
+	Level string `json:"level" validate:"required"`
+}
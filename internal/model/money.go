@@ -0,0 +1,84 @@
+package model
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in minor units (kopecks)
+type Money int64
+
+// BaseCurrency is the currency of subscriptions created without one and of
+// totals requested without a target currency
+const BaseCurrency = "RUB"
+
+var errInvalidMoney = errors.New("invalid amount, expected a decimal with at most 2 fraction digits")
+
+// ParseMoney parses a decimal amount such as "299.99", "400" or "0.5" exactly
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" || (hasFrac && (frac == "" || len(frac) > 2)) || !digits(whole) || !digits(frac) {
+		return 0, errInvalidMoney
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	n, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, errInvalidMoney
+	}
+	if neg {
+		n = -n
+	}
+	return Money(n), nil
+}
+
+func digits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the amount as a decimal with two fraction digits
+func (m Money) String() string {
+	n := int64(m)
+	sign := ""
+	if n < 0 {
+		sign = "-"
+		n = -n
+	}
+	frac := strconv.FormatInt(n%100, 10)
+	if len(frac) < 2 {
+		frac = "0" + frac
+	}
+	return sign + strconv.FormatInt(n/100, 10) + "." + frac
+}
+
+// MarshalJSON renders the amount as a JSON number, e.g. 299.99
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a string holding a decimal
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if unq, err := strconv.Unquote(s); err == nil {
+		s = unq
+	}
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
@@ -0,0 +1,47 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Money
+		ok   bool
+	}{
+		{"400", 40000, true},
+		{"299.99", 29999, true},
+		{"0.5", 50, true},
+		{"-1.05", -105, true},
+		{"1.999", 0, false},
+		{"1.", 0, false},
+		{".5", 0, false},
+		{"1e3", 0, false},
+		{"abc", 0, false},
+	}
+	for _, c := range cases {
+		got, err := ParseMoney(c.in)
+		if (err == nil) != c.ok || got != c.want {
+			t.Fatalf("ParseMoney(%q) = %v, %v; want %v, ok=%v", c.in, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var req struct {
+		A Money `json:"a"`
+		B Money `json:"b"`
+	}
+	if err := json.Unmarshal([]byte(`{"a": 299.99, "b": "400"}`), &req); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if req.A != 29999 || req.B != 40000 {
+		t.Fatalf("unexpected amounts: %+v", req)
+	}
+	out, _ := json.Marshal(req)
+	if string(out) != `{"a":299.99,"b":400.00}` {
+		t.Fatalf("unexpected json: %s", out)
+	}
+}
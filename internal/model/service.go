@@ -0,0 +1,37 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Catalog entry of a service; subscriptions reference it by id and keep the
+// name they were entered with
+type Service struct {
+	ID           uuid.UUID `db:"id" json:"id"`
+	Name         string    `db:"name" json:"name"`
+	DefaultPrice *Money    `db:"default_price" json:"default_price,omitempty"`
+	Currency     string    `db:"currency" json:"currency"`
+	// normalized names the service is found by, including its own
+	Aliases []string `db:"-" json:"aliases,omitempty"`
+}
+
+// Service request body
+type ServiceRequest struct {
+	Name         string   `json:"name" validate:"required,max=100"`
+	Aliases      []string `json:"aliases,omitempty" validate:"omitempty,max=50,dive,required,max=100"`
+	DefaultPrice *Money   `json:"default_price,omitempty" validate:"omitempty,min=0"`
+	Currency     string   `json:"currency,omitempty" validate:"omitempty,iso4217"`
+}
+
+// Aliases request body
+type AliasesRequest struct {
+	Aliases []string `json:"aliases" validate:"required,min=1,max=50,dive,required,max=100"`
+}
+
+// ServiceKey normalizes a service name for lookups: lower case with single spaces,
+// so "Yandex  Plus" and "yandex plus" are the same service
+func ServiceKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
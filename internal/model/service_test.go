@@ -0,0 +1,17 @@
+package model
+
+import "testing"
+
+func TestServiceKey(t *testing.T) {
+	cases := map[string]string{
+		"Yandex Plus":       "yandex plus",
+		"  yandex   PLUS\t": "yandex plus",
+		"Яндекс Плюс":       "яндекс плюс",
+		"":                  "",
+	}
+	for in, want := range cases {
+		if got := ServiceKey(in); got != want {
+			t.Fatalf("ServiceKey(%q) = %q; want %q", in, got, want)
+		}
+	}
+}
@@ -9,17 +9,138 @@ import (
 type Subscription struct {
 	ID          uuid.UUID  `db:"id" json:"id"`
 	ServiceName string     `db:"service_name" json:"service_name"`
-	Price       int        `db:"price" json:"price"`
+	ServiceID   *uuid.UUID `db:"service_id" json:"service_id,omitempty"`
+	Price       Money      `db:"price" json:"price"`
 	UserID      uuid.UUID  `db:"user_id" json:"user_id"`
 	StartDate   time.Time  `db:"start_date" json:"start_date"`
 	EndDate     *time.Time `db:"end_date" json:"end_date,omitempty"`
+	// day of month the subscription is charged on, clamped to the month length
+	BillingDay int `db:"billing_day" json:"billing_day"`
+	// last free month of a trial, inclusive
+	TrialEnd *time.Time `db:"trial_end" json:"trial_end,omitempty"`
+	// ISO 4217 code of Price
+	Currency string    `db:"currency" json:"currency"`
+	Discount *Discount `db:"discount" json:"discount,omitempty"`
+	// how the price is split with members of a shared subscription
+	Split string `db:"split" json:"split,omitempty"`
+	// categories the subscription belongs to, lower case
+	Tags []string `db:"-" json:"tags,omitempty"`
+	// name of the service in the catalog, ServiceName is the name as entered
+	CanonicalName string `db:"canonical_name" json:"canonical_name,omitempty"`
+}
+
+// BillingStart is the first paid month, the month after the trial if there is one
+func (s *Subscription) BillingStart() time.Time {
+	if s.TrialEnd != nil {
+		if next := s.TrialEnd.AddDate(0, 1, 0); next.After(s.StartDate) {
+			return next
+		}
+	}
+	return s.StartDate
 }
 
 // Create/Update request body
 type SubscriptionRequest struct {
-	ServiceName string  `json:"service_name" validate:"required,min=1"`
-	Price       int     `json:"price" validate:"required,min=0"`
-	UserID      string  `json:"user_id" validate:"required,uuid4"`
-	StartDate   string  `json:"start_date" validate:"required"`
-	EndDate     *string `json:"end_date,omitempty"`
+	ServiceName string `json:"service_name" validate:"required,min=1"`
+	// defaults to the catalog price of the service when omitted or null
+	Price      *Money    `json:"price" validate:"omitempty,min=0"`
+	UserID     string    `json:"user_id" validate:"required,uuid4"`
+	StartDate  string    `json:"start_date" validate:"required"`
+	EndDate    *string   `json:"end_date,omitempty"`
+	BillingDay *int      `json:"billing_day,omitempty" validate:"omitempty,min=1,max=31"`
+	TrialEnd   *string   `json:"trial_end,omitempty"`
+	Currency   string    `json:"currency,omitempty" validate:"omitempty,iso4217"`
+	Discount   *Discount `json:"discount,omitempty"`
+	// MM-YYYY, month a changed price applies from on update (defaults to the current month)
+	PriceEffectiveFrom *string `json:"price_effective_from,omitempty"`
+	// replaces the tags when set, an empty list removes them
+	Tags []string `json:"tags,omitempty" validate:"omitempty,max=20,dive,required,max=32"`
+}
+
+// Projected spend for a single month (MM-YYYY)
+type MonthTotal struct {
+	Month    string `json:"month"`
+	Total    Money  `json:"total"`
+	Currency string `json:"currency"`
+}
+
+// Total spend for a period
+type AggregateTotal struct {
+	Total      Money           `json:"total"`
+	Currency   string          `json:"currency"`
+	Categories []CategoryTotal `json:"categories,omitempty"`
+}
+
+// Spend of the subscriptions with a tag, Category is nil for untagged ones
+type CategoryTotal struct {
+	Category *string `json:"category"`
+	Total    Money   `json:"total"`
+}
+
+// Upcoming charge of a subscription
+type Renewal struct {
+	Subscription
+	RenewalDate time.Time `json:"renewal_date"`
+}
+
+// Months from StartDate to EndDate (inclusive, open-ended if nil) in which a subscription is not charged
+type Pause struct {
+	ID             uuid.UUID  `db:"id" json:"id"`
+	SubscriptionID uuid.UUID  `db:"subscription_id" json:"subscription_id"`
+	StartDate      time.Time  `db:"start_date" json:"start_date"`
+	EndDate        *time.Time `db:"end_date" json:"end_date,omitempty"`
+}
+
+// Pause request body, months default to the current one
+type PauseRequest struct {
+	From *string `json:"from,omitempty"`
+	To   *string `json:"to,omitempty"`
+}
+
+// Resume request body, the month defaults to the current one
+type ResumeRequest struct {
+	Month *string `json:"month,omitempty"`
+}
+
+// Price in effect from a month until the next point of the schedule
+type PricePoint struct {
+	SubscriptionID uuid.UUID `db:"subscription_id" json:"-"`
+	EffectiveFrom  time.Time `db:"effective_from" json:"effective_from"`
+	Price          Money     `db:"price" json:"price"`
+}
+
+// Units of Currency per 1 EUR on Date, Rate is a decimal string
+type ExchangeRate struct {
+	Date     time.Time `db:"date" json:"date"`
+	Currency string    `db:"currency" json:"currency"`
+	Rate     string    `db:"rate" json:"rate"`
+}
+
+// Split rules of shared subscriptions
+const (
+	SplitEqual   = "equal"
+	SplitPercent = "percent"
+	SplitFixed   = "fixed"
+)
+
+// User sharing a subscription with its owner, Percent or Amount is set depending on the split rule
+type Member struct {
+	SubscriptionID uuid.UUID `db:"subscription_id" json:"-"`
+	UserID         uuid.UUID `db:"user_id" json:"user_id" validate:"required"`
+	Percent        *int      `db:"percent" json:"percent,omitempty" validate:"omitempty,min=1,max=100"`
+	Amount         *Money    `db:"amount" json:"amount,omitempty" validate:"omitempty,min=0"`
+}
+
+// Members request body, replaces all members of a subscription
+type MembersRequest struct {
+	Split   string   `json:"split" validate:"required,oneof=equal percent fixed"`
+	Members []Member `json:"members" validate:"dive"`
+}
+
+// Amount one user owes another for a period
+type Debt struct {
+	From     uuid.UUID `json:"from_user_id"`
+	To       uuid.UUID `json:"to_user_id"`
+	Amount   Money     `json:"amount"`
+	Currency string    `json:"currency"`
 }
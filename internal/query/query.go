@@ -0,0 +1,267 @@
+// Package query parses the search language of GET /subscriptions/?q=, e.g.
+//
+//	service:netflix price>=300 active:2025-03 -tag:work
+//
+// Terms are separated by spaces and all of them must match. A term is a field,
+// an operator and a value; values with spaces are double quoted. Fields:
+//
+//	service:NAME   service name or catalog alias, NAME* matches a prefix
+//	service~NAME   service name similar to NAME, for misspellings
+//	tag:NAME       has the tag
+//	price OP N     price in its own currency, OP is one of : = > >= < <=
+//	active:MONTH   active in the month, YYYY-MM or MM-YYYY
+//	currency:CODE  priced in the ISO 4217 currency
+//	user:UUID      owned by or shared with the user
+//
+// service and tag terms can be negated with a leading '-'.
+package query
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/effectivemobile/subscriptions/internal/store"
+	"github.com/google/uuid"
+)
+
+// SyntaxError is an error in a query at Pos, the 1-based character offset
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+// term is a single field comparison, positions are byte offsets into the query
+type term struct {
+	negated  bool
+	field    string
+	op       string
+	value    string
+	fieldPos int
+	valuePos int
+}
+
+// Parse applies the terms of q to f, overriding filters already set there;
+// the values end up as query arguments, never in the SQL text
+func Parse(q string, f *store.Filter) error {
+	terms, err := lex(q)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, t := range terms {
+		fail := func(pos int, format string, args ...interface{}) error {
+			return errorAt(q, pos, format, args...)
+		}
+		switch t.field {
+		case "service", "tag":
+		default:
+			if t.negated {
+				return fail(t.fieldPos-1, "%s cannot be negated", t.field)
+			}
+		}
+		switch {
+		case t.op == "~" && t.field == "service" && !t.negated:
+		case t.op == "~":
+			return fail(t.fieldPos+len(t.field), "only service supports '~'")
+		case t.op != ":" && t.field != "price":
+			return fail(t.fieldPos+len(t.field), "%s only supports ':'", t.field)
+		}
+		// single valued fields, a second term could only contradict the first;
+		// price has a lower and an upper bound
+		keys := []string{t.field}
+		switch t.op {
+		case ":", "=":
+			if t.field == "price" {
+				keys = []string{"price>", "price<"}
+			}
+		case ">", ">=":
+			keys = []string{"price>"}
+		case "<", "<=":
+			keys = []string{"price<"}
+		}
+		if !t.negated && t.field != "tag" {
+			for _, k := range keys {
+				if seen[k] {
+					return fail(t.fieldPos, "duplicate %s term", t.field)
+				}
+				seen[k] = true
+			}
+		}
+		switch t.field {
+		case "service":
+			name := t.value
+			if t.negated {
+				f.ExcludeServices = append(f.ExcludeServices, name)
+				continue
+			}
+			f.Match = store.MatchExact
+			if t.op == "~" {
+				f.Match = store.MatchFuzzy
+			} else if strings.HasSuffix(name, "*") {
+				name = strings.TrimSuffix(name, "*")
+				f.Match = store.MatchPrefix
+			}
+			if name == "" {
+				return fail(t.valuePos, "empty service name")
+			}
+			f.ServiceName = &name
+		case "tag":
+			tag := strings.ToLower(t.value)
+			if t.negated {
+				f.ExcludeTags = append(f.ExcludeTags, tag)
+			} else {
+				f.Tags = append(f.Tags, tag)
+			}
+		case "price":
+			price, err := model.ParseMoney(t.value)
+			if err != nil || price < 0 {
+				return fail(t.valuePos, "invalid price %q", t.value)
+			}
+			// bounds are inclusive, a strict one is a kopeck further
+			switch t.op {
+			case ":", "=":
+				f.PriceMin, f.PriceMax = &price, &price
+			case ">=":
+				f.PriceMin = &price
+			case ">":
+				price++
+				f.PriceMin = &price
+			case "<=":
+				f.PriceMax = &price
+			case "<":
+				price--
+				f.PriceMax = &price
+			}
+		case "active":
+			month, err := parseMonth(t.value)
+			if err != nil {
+				return fail(t.valuePos, "invalid month %q, expected YYYY-MM or MM-YYYY", t.value)
+			}
+			end := month.AddDate(0, 1, -1)
+			f.ActiveFrom, f.ActiveTo = &month, &end
+		case "currency":
+			code := strings.ToUpper(t.value)
+			if len(code) != 3 || strings.IndexFunc(code, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+				return fail(t.valuePos, "invalid currency %q", t.value)
+			}
+			f.Currency = &code
+		case "user":
+			id, err := uuid.Parse(t.value)
+			if err != nil {
+				return fail(t.valuePos, "invalid user id %q", t.value)
+			}
+			f.UserID = &id
+		}
+	}
+	return nil
+}
+
+var fields = map[string]bool{"service": true, "tag": true, "price": true, "active": true, "currency": true, "user": true}
+
+// lex splits q into terms
+func lex(q string) ([]term, error) {
+	var terms []term
+	fail := func(pos int, format string, args ...interface{}) error {
+		return errorAt(q, pos, format, args...)
+	}
+	i := 0
+	for {
+		for i < len(q) {
+			r, size := utf8.DecodeRuneInString(q[i:])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			i += size
+		}
+		if i == len(q) {
+			return terms, nil
+		}
+		var t term
+		if q[i] == '-' {
+			t.negated = true
+			i++
+		}
+		t.fieldPos = i
+		for i < len(q) && (q[i] >= 'a' && q[i] <= 'z' || q[i] >= 'A' && q[i] <= 'Z') {
+			i++
+		}
+		t.field = strings.ToLower(q[t.fieldPos:i])
+		if t.field == "" {
+			return nil, fail(t.fieldPos, "expected a field name")
+		}
+		if !fields[t.field] {
+			return nil, fail(t.fieldPos, "unknown field %q", t.field)
+		}
+		opPos := i
+		for _, op := range []string{">=", "<=", ":", "=", ">", "<", "~"} {
+			if strings.HasPrefix(q[i:], op) {
+				t.op = op
+				i += len(op)
+				break
+			}
+		}
+		if t.op == "" {
+			return nil, fail(opPos, "expected an operator after %s", t.field)
+		}
+		t.valuePos = i
+		if i < len(q) && q[i] == '"' {
+			var b strings.Builder
+			i++
+			for {
+				if i == len(q) {
+					return nil, fail(t.valuePos, "unterminated quoted value")
+				}
+				if q[i] == '"' {
+					i++
+					break
+				}
+				if q[i] == '\\' && i+1 < len(q) {
+					i++
+				}
+				b.WriteByte(q[i])
+				i++
+			}
+			t.value = b.String()
+			if r, _ := utf8.DecodeRuneInString(q[i:]); i < len(q) && !unicode.IsSpace(r) {
+				return nil, fail(i, "expected a space after the quoted value")
+			}
+		} else {
+			start := i
+			for i < len(q) {
+				r, size := utf8.DecodeRuneInString(q[i:])
+				if unicode.IsSpace(r) {
+					break
+				}
+				if r == '"' {
+					return nil, fail(i, "unexpected quote")
+				}
+				i += size
+			}
+			t.value = q[start:i]
+		}
+		if t.value == "" {
+			return nil, fail(t.valuePos, "expected a value for %s", t.field)
+		}
+		terms = append(terms, t)
+	}
+}
+
+// errorAt reports a syntax error at byte offset pos of q
+func errorAt(q string, pos int, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: utf8.RuneCountInString(q[:pos]) + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+func parseMonth(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01", s); err == nil {
+		return t, nil
+	}
+	return time.Parse("01-2006", s)
+}
@@ -0,0 +1,84 @@
+package query
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/store"
+)
+
+func TestParse(t *testing.T) {
+	var f store.Filter
+	if err := Parse(`service:netflix price>=300 active:2025-03 -tag:work tag:Video currency:usd`, &f); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.ServiceName == nil || *f.ServiceName != "netflix" || f.Match != store.MatchExact {
+		t.Fatalf("unexpected service filter: %v %s", f.ServiceName, f.Match)
+	}
+	if f.PriceMin == nil || *f.PriceMin != 30000 || f.PriceMax != nil {
+		t.Fatalf("unexpected price bounds: %v %v", f.PriceMin, f.PriceMax)
+	}
+	march := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	if f.ActiveFrom == nil || !f.ActiveFrom.Equal(march) || !f.ActiveTo.Equal(march.AddDate(0, 1, -1)) {
+		t.Fatalf("unexpected active range: %v %v", f.ActiveFrom, f.ActiveTo)
+	}
+	if len(f.Tags) != 1 || f.Tags[0] != "video" || len(f.ExcludeTags) != 1 || f.ExcludeTags[0] != "work" {
+		t.Fatalf("unexpected tags: %v %v", f.Tags, f.ExcludeTags)
+	}
+	if f.Currency == nil || *f.Currency != "USD" {
+		t.Fatalf("unexpected currency: %v", f.Currency)
+	}
+
+	f = store.Filter{}
+	if err := Parse(`service:"yandex pl*" price<100.50 price>1 -service:Okko active:03-2025`, &f); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *f.ServiceName != "yandex pl" || f.Match != store.MatchPrefix || *f.PriceMax != 10049 || *f.PriceMin != 101 {
+		t.Fatalf("unexpected filter: %+v", f)
+	}
+	if len(f.ExcludeServices) != 1 || f.ExcludeServices[0] != "Okko" {
+		t.Fatalf("unexpected excluded services: %v", f.ExcludeServices)
+	}
+}
+
+func TestParse_Fuzzy(t *testing.T) {
+	var f store.Filter
+	if err := Parse(`service~netflx`, &f); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *f.ServiceName != "netflx" || f.Match != store.MatchFuzzy {
+		t.Fatalf("unexpected filter: %+v", f)
+	}
+}
+
+func TestParse_SyntaxErrors(t *testing.T) {
+	cases := []struct {
+		q   string
+		pos int
+	}{
+		{`color:red`, 1},
+		{`service:netflix price~3`, 22},
+		{`price>=abc`, 8},
+		{`tag:`, 5},
+		{`service:"netflix`, 9},
+		{`service:"a"b`, 12},
+		{`-price:3`, 1},
+		{`active:2025-13`, 8},
+		{`тег:x`, 1},
+		{`service:кино price:1 price<3`, 22},
+		{`tag>music`, 4},
+		{`tag~music`, 4},
+	}
+	for _, c := range cases {
+		var f store.Filter
+		err := Parse(c.q, &f)
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Fatalf("Parse(%q): expected a syntax error, got %v", c.q, err)
+		}
+		if se.Pos != c.pos {
+			t.Fatalf("Parse(%q): error at %d (%v); want %d", c.q, se.Pos, se, c.pos)
+		}
+	}
+}
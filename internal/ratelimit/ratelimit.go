@@ -0,0 +1,182 @@
+// Package ratelimit throttles clients with token buckets and sheds load above a concurrency cap.
+package ratelimit
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/tracing"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// idle buckets are dropped this often so that the map does not grow with every client seen
+const sweepInterval = time.Minute
+
+// Limiter keeps a token bucket per client key: a client may make burst requests
+// at once and then rate requests per second
+type Limiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Result of taking a token
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// until the bucket is full again
+	Reset time.Duration
+	// until the next token, zero when allowed
+	RetryAfter time.Duration
+}
+
+// New returns a limiter of rate requests per second, burst defaults to the rate rounded up
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &Limiter{rate: rate, burst: float64(burst), now: time.Now, buckets: map[string]*bucket{}}
+}
+
+// Allow takes a token from the bucket of key
+func (l *Limiter) Allow(key string) Result {
+	return l.take(key, true)
+}
+
+// take refills the bucket of key and, when consume is set, takes a token from
+// it; without consume it only reports whether a token is left
+func (l *Limiter) take(key string, consume bool) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	res := Result{Limit: int(l.burst)}
+	if b.tokens >= 1 {
+		if consume {
+			b.tokens--
+		}
+		res.Allowed = true
+	} else {
+		res.RetryAfter = l.duration(1 - b.tokens)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = l.duration(l.burst - b.tokens)
+	return res
+}
+
+// duration is the time to refill tokens
+func (l *Limiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled, they are the same as new ones
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Middleware limits each client, as told apart by key, answering 429 with
+// Retry-After once its bucket is empty; every response carries X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-RateLimit-Reset (seconds until the bucket is full)
+func (l *Limiter) Middleware(key func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res := l.Allow(key(r))
+			h := w.Header()
+			h.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+			h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			h.Set("X-RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+			if !res.Allowed {
+				h.Set("Retry-After", strconv.Itoa(seconds(res.RetryAfter)))
+				writeError(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Penalize limits the requests that fail, as told by failed from the status of
+// the response: each failure takes a token from the bucket of the client and a
+// client with an empty bucket gets 429 without reaching next. In front of
+// authentication it keeps clients from trying credentials, and costing a
+// lookup each, at the rate of the limits that apply only once authenticated.
+func (l *Limiter) Penalize(key func(*http.Request) string, failed func(status int) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k := key(r)
+			if res := l.take(k, false); !res.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(seconds(res.RetryAfter)))
+				writeError(w, r, http.StatusTooManyRequests, "too many failed requests")
+				return
+			}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			if failed(ww.Status()) {
+				l.take(k, true)
+			}
+		})
+	}
+}
+
+// Shedder caps the requests served at once
+type Shedder struct {
+	slots chan struct{}
+}
+
+func NewShedder(max int) *Shedder {
+	return &Shedder{slots: make(chan struct{}, max)}
+}
+
+// Middleware answers 503 with Retry-After instead of queueing requests beyond the cap
+func (s *Shedder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case s.slots <- struct{}{}:
+			defer func() { <-s.slots }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, "server is overloaded, retry later")
+		}
+	})
+}
+
+// seconds rounds up, so that a client waiting that long is let through
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(tracing.ErrorBody(r.Context(), msg))
+}
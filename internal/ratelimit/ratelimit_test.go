@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/auth"
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+	l := New(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if res := l.Allow("a"); !res.Allowed || res.Remaining != 2-i {
+			t.Fatalf("request %d: unexpected result %+v", i, res)
+		}
+	}
+	res := l.Allow("a")
+	if res.Allowed || res.RetryAfter != 500*time.Millisecond || res.Reset != 1500*time.Millisecond {
+		t.Fatalf("expected the empty bucket to refuse, got %+v", res)
+	}
+	// other clients have their own bucket
+	if res := l.Allow("b"); !res.Allowed {
+		t.Fatalf("expected another key to be allowed, got %+v", res)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if res := l.Allow("a"); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("expected a refilled token, got %+v", res)
+	}
+
+	// refilled buckets are dropped on the next sweep
+	now = now.Add(time.Hour)
+	l.Allow("c")
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected idle buckets to be swept, got %d", len(l.buckets))
+	}
+}
+
+func TestLimiter_Middleware(t *testing.T) {
+	l := New(1, 1)
+	h := l.Middleware(func(r *http.Request) string { return r.RemoteAddr })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/subscriptions/aggregate", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Limit") != "1" || rr.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("unexpected first response: %d %v", rr.Code, rr.Header())
+	}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/subscriptions/aggregate", nil))
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected 429 with Retry-After, got %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestShedder(t *testing.T) {
+	s := NewShedder(1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	<-started
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected 503 with Retry-After, got %d %v", rr.Code, rr.Header())
+	}
+	close(release)
+	wg.Wait()
+
+	// the slot is free again
+	release = make(chan struct{})
+	close(release)
+	started = make(chan struct{})
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 after the slot was released, got %d", rr.Code)
+	}
+}
+
+type noKeys struct {
+	lookups int
+	// returned instead of sql.ErrNoRows when set
+	err error
+}
+
+func (k *noKeys) FindAPIKey(prefix string) (*model.APIKey, error) {
+	k.lookups++
+	if k.err != nil {
+		return nil, k.err
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (k *noKeys) TouchAPIKey(id uuid.UUID, at time.Time) error { return nil }
+
+func TestLimiter_PenalizeFailedAuth(t *testing.T) {
+	l := New(1, 3)
+	keys := &noKeys{}
+	unauthorized := func(status int) bool { return status == http.StatusUnauthorized }
+	h := l.Penalize(func(r *http.Request) string { return "ip:" + r.RemoteAddr }, unauthorized)(
+		auth.Middleware(nil, keys)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	key := "sk_0123456789ab_" + strings.Repeat("0", 64)
+	codes := make([]int, 0, 5)
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/subscriptions/", nil)
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		codes = append(codes, rr.Code)
+	}
+	if codes[2] != http.StatusUnauthorized || codes[3] != http.StatusTooManyRequests || codes[4] != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the failures used up the burst, got %v", codes)
+	}
+	if keys.lookups != 3 {
+		t.Fatalf("expected rejected requests not to reach the key store, got %d lookups", keys.lookups)
+	}
+
+	// successful requests cost nothing
+	l2 := New(1, 1)
+	ok := l2.Penalize(func(r *http.Request) string { return "ip" }, unauthorized)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		ok.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rr.Code)
+		}
+	}
+}
+
+func TestLimiter_PenalizeIgnoresStoreErrors(t *testing.T) {
+	l := New(1, 1)
+	keys := &noKeys{err: errors.New("connection refused")}
+	unauthorized := func(status int) bool { return status == http.StatusUnauthorized }
+	h := l.Penalize(func(r *http.Request) string { return "ip" }, unauthorized)(
+		auth.Middleware(nil, keys)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	key := "sk_0123456789ab_" + strings.Repeat("0", 64)
+	serve := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/subscriptions/", nil)
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	for i := 0; i < 3; i++ {
+		if code := serve(); code != http.StatusServiceUnavailable {
+			t.Fatalf("request %d during the outage: expected 503, got %d", i, code)
+		}
+	}
+
+	// once the store is back the client still has its whole burst
+	keys.err = nil
+	if code := serve(); code != http.StatusUnauthorized {
+		t.Fatalf("expected the outage not to take a token, got %d", code)
+	}
+	if code := serve(); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the failure used up the burst, got %d", code)
+	}
+}
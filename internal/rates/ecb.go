@@ -0,0 +1,57 @@
+// Package rates reads exchange rates published by the European Central Bank.
+package rates
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+)
+
+// ParseECB reads an ECB-style CSV (eurofxref-hist.csv): a Date column followed by
+// one column per currency holding units of that currency per 1 EUR; empty and
+// N/A cells are skipped
+func ParseECB(r io.Reader) ([]model.ExchangeRate, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	if len(header) < 2 || !strings.EqualFold(strings.TrimSpace(header[0]), "Date") {
+		return nil, fmt.Errorf("unexpected header, first column must be Date")
+	}
+	var res []model.ExchangeRate
+	line := 1
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		date, err := time.Parse("2006-01-02", strings.TrimSpace(rec[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid date %q", line, rec[0])
+		}
+		for i := 1; i < len(rec) && i < len(header); i++ {
+			code := strings.ToUpper(strings.TrimSpace(header[i]))
+			v := strings.TrimSpace(rec[i])
+			if code == "" || v == "" || v == "N/A" {
+				continue
+			}
+			if rate, ok := new(big.Rat).SetString(v); !ok || rate.Sign() <= 0 {
+				return nil, fmt.Errorf("line %d: invalid %s rate %q", line, code, v)
+			}
+			res = append(res, model.ExchangeRate{Date: date, Currency: code, Rate: v})
+		}
+	}
+	return res, nil
+}
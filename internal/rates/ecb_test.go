@@ -0,0 +1,37 @@
+package rates
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseECB(t *testing.T) {
+	csv := "Date,USD,JPY,RUB,\n" +
+		"2025-07-02,1.1787,169.51,N/A,\n" +
+		"2025-07-01,1.1795,169.62,92.5,\n"
+	got, err := ParseECB(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if len(got) != 5 {
+		t.Fatalf("expected 5 rates, got %d: %+v", len(got), got)
+	}
+	last := got[4]
+	if last.Currency != "RUB" || last.Rate != "92.5" || !last.Date.Equal(time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected rate: %+v", last)
+	}
+}
+
+func TestParseECB_Invalid(t *testing.T) {
+	for _, csv := range []string{
+		"USD,JPY\n1,2\n",
+		"Date,USD\n07-2025,1.1\n",
+		"Date,USD\n2025-07-01,abc\n",
+		"Date,USD\n2025-07-01,-1\n",
+	} {
+		if _, err := ParseECB(strings.NewReader(csv)); err == nil {
+			t.Fatalf("expected error for %q", csv)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const apiKeyColumns = `id, name, prefix, hash, scopes, created_at, last_used_at, revoked_at`
+
+// last_used_at is written at most this often per key, not on every request
+const touchInterval = time.Minute
+
+type apiKeyRow struct {
+	model.APIKey
+	Scopes pq.StringArray `db:"scopes"`
+}
+
+func (r apiKeyRow) key() model.APIKey {
+	k := r.APIKey
+	k.Scopes = []string(r.Scopes)
+	return k
+}
+
+func (p *PostgresRepo) CreateAPIKey(k *model.APIKey) error {
+	if k.ID == uuid.Nil {
+		k.ID = uuid.New()
+	}
+	q := `INSERT INTO api_keys (id, name, prefix, hash, scopes) VALUES ($1,$2,$3,$4,$5) RETURNING created_at`
+	return p.db.Get(&k.CreatedAt, q, k.ID, k.Name, k.Prefix, k.Hash, pq.Array(k.Scopes))
+}
+
+// ListAPIKeys returns all keys including revoked ones, newest first
+func (p *PostgresRepo) ListAPIKeys() ([]model.APIKey, error) {
+	var rows []apiKeyRow
+	if err := p.db.Select(&rows, `SELECT `+apiKeyColumns+` FROM api_keys ORDER BY created_at DESC`); err != nil {
+		return nil, err
+	}
+	res := make([]model.APIKey, 0, len(rows))
+	for _, r := range rows {
+		res = append(res, r.key())
+	}
+	return res, nil
+}
+
+// RevokeAPIKey disables a key for good, sql.ErrNoRows is returned for an unknown or revoked key
+func (p *PostgresRepo) RevokeAPIKey(id uuid.UUID) error {
+	res, err := p.db.Exec(`UPDATE api_keys SET revoked_at = now() WHERE id=$1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RotateAPIKey replaces the secret of a key keeping its name and scopes, the
+// old secret stops working at once. sql.ErrNoRows is returned for an unknown or revoked key
+func (p *PostgresRepo) RotateAPIKey(id uuid.UUID, prefix string, hash []byte) (*model.APIKey, error) {
+	var r apiKeyRow
+	q := `UPDATE api_keys SET prefix=$2, hash=$3, last_used_at=NULL WHERE id=$1 AND revoked_at IS NULL RETURNING ` + apiKeyColumns
+	if err := p.db.Get(&r, q, id, prefix, hash); err != nil {
+		return nil, err
+	}
+	k := r.key()
+	return &k, nil
+}
+
+// FindAPIKey returns the active key with the prefix, sql.ErrNoRows if there is none
+func (p *PostgresRepo) FindAPIKey(prefix string) (*model.APIKey, error) {
+	var r apiKeyRow
+	if err := p.db.Get(&r, `SELECT `+apiKeyColumns+` FROM api_keys WHERE prefix=$1 AND revoked_at IS NULL`, prefix); err != nil {
+		return nil, err
+	}
+	k := r.key()
+	return &k, nil
+}
+
+// TouchAPIKey records the use of a key at at
+func (p *PostgresRepo) TouchAPIKey(id uuid.UUID, at time.Time) error {
+	q := `UPDATE api_keys SET last_used_at=$2 WHERE id=$1 AND (last_used_at IS NULL OR last_used_at < $3)`
+	_, err := p.db.Exec(q, id, at, at.Add(-touchInterval))
+	return err
+}
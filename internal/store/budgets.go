@@ -0,0 +1,45 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrBudgetExists is returned when the user already has a budget for the same scope
+var ErrBudgetExists = errors.New("budget already exists")
+
+func (p *PostgresRepo) CreateBudget(b *model.Budget) error {
+	q := `INSERT INTO budgets (id, user_id, category, service_name, amount, currency) VALUES ($1,$2,$3,$4,$5,$6)`
+	if b.ID == uuid.Nil {
+		b.ID = uuid.New()
+	}
+	if b.Currency == "" {
+		b.Currency = model.BaseCurrency
+	}
+	if _, err := p.db.Exec(q, b.ID, b.UserID, b.Category, b.ServiceName, b.Amount, b.Currency); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrBudgetExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (p *PostgresRepo) ListBudgets(userID uuid.UUID) ([]model.Budget, error) {
+	q := `SELECT id, user_id, category, service_name, amount, currency FROM budgets WHERE user_id=$1
+	ORDER BY category NULLS FIRST, service_name NULLS FIRST`
+	budgets := []model.Budget{}
+	if err := p.db.Select(&budgets, q, userID); err != nil {
+		return nil, err
+	}
+	return budgets, nil
+}
+
+func (p *PostgresRepo) DeleteBudget(id uuid.UUID) error {
+	_, err := p.db.Exec(`DELETE FROM budgets WHERE id=$1`, id)
+	return err
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/google/uuid"
+)
+
+// SetCalendarToken sets the token of the calendar feed of the user, replacing
+// the previous one, which stops working at once
+func (p *PostgresRepo) SetCalendarToken(userID uuid.UUID, hash []byte) error {
+	q := `INSERT INTO calendar_tokens (user_id, hash) VALUES ($1,$2)
+	ON CONFLICT (user_id) DO UPDATE SET hash = EXCLUDED.hash, created_at = now()`
+	_, err := p.db.Exec(q, userID, hash)
+	return err
+}
+
+// DeleteCalendarToken revokes the calendar feed of the user, sql.ErrNoRows is returned if there is none
+func (p *PostgresRepo) DeleteCalendarToken(userID uuid.UUID) error {
+	res, err := p.db.Exec(`DELETE FROM calendar_tokens WHERE user_id=$1`, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// FindCalendarToken returns the user of the calendar feed token, sql.ErrNoRows if there is none
+func (p *PostgresRepo) FindCalendarToken(hash []byte) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := p.db.Get(&id, `SELECT user_id FROM calendar_tokens WHERE hash=$1`, hash)
+	return id, err
+}
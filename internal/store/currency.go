@@ -0,0 +1,136 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// rates are quoted against the euro
+const quoteCurrency = "EUR"
+
+var ErrNoRate = errors.New("no exchange rate")
+
+// converter converts monthly amounts into the target currency at the rate in
+// effect at the end of each month
+type converter struct {
+	target string
+	// rates per currency sorted by date
+	rates map[string][]model.ExchangeRate
+}
+
+// loadConverter loads the rates needed to convert subs into target for the months of [from,to]
+func loadConverter(q sqlx.Queryer, target string, subs []model.Subscription, from, to time.Time) (*converter, error) {
+	c := &converter{target: target, rates: map[string][]model.ExchangeRate{}}
+	codes := []string{}
+	seen := map[string]bool{quoteCurrency: true}
+	for _, s := range subs {
+		if cur := currencyOf(&s); cur != target && !seen[cur] {
+			seen[cur] = true
+			codes = append(codes, cur)
+		}
+	}
+	if len(codes) == 0 {
+		return c, nil
+	}
+	if !seen[target] {
+		codes = append(codes, target)
+	}
+	// the latest rate of a month may have been published shortly before it started
+	var rates []model.ExchangeRate
+	err := sqlx.Select(q, &rates, `SELECT date, currency, rate FROM exchange_rates
+	WHERE currency = ANY($1) AND date >= $2 AND date <= $3 ORDER BY date`,
+		pq.Array(codes), firstOfMonth(from).AddDate(0, -1, 0), firstOfMonth(to).AddDate(0, 1, -1))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rates {
+		c.rates[r.Currency] = append(c.rates[r.Currency], r)
+	}
+	return c, nil
+}
+
+// convert converts amount in currency to the target currency at the rate of the
+// month of t, rounding half away from zero to minor units
+func (c *converter) convert(amount model.Money, currency string, t time.Time) (model.Money, error) {
+	if c == nil || currency == c.target || amount == 0 {
+		return amount, nil
+	}
+	monthEnd := firstOfMonth(t).AddDate(0, 1, -1)
+	from, err := c.rateAt(currency, monthEnd)
+	if err != nil {
+		return 0, err
+	}
+	to, err := c.rateAt(c.target, monthEnd)
+	if err != nil {
+		return 0, err
+	}
+	v := new(big.Rat).SetInt64(int64(amount))
+	v.Mul(v, to).Quo(v, from)
+	return roundMoney(v), nil
+}
+
+// rateAt returns units of currency per 1 EUR as of t
+func (c *converter) rateAt(currency string, t time.Time) (*big.Rat, error) {
+	if currency == quoteCurrency {
+		return big.NewRat(1, 1), nil
+	}
+	var rate string
+	for _, r := range c.rates[currency] {
+		if r.Date.After(t) {
+			break
+		}
+		rate = r.Rate
+	}
+	if rate == "" {
+		return nil, fmt.Errorf("%w for %s in %s", ErrNoRate, currency, t.Format("01-2006"))
+	}
+	v, ok := new(big.Rat).SetString(rate)
+	if !ok || v.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid %s rate %q", currency, rate)
+	}
+	return v, nil
+}
+
+func roundMoney(v *big.Rat) model.Money {
+	num, den := new(big.Int).Set(v.Num()), v.Denom()
+	neg := num.Sign() < 0
+	num.Abs(num)
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if r.Mul(r, big.NewInt(2)).Cmp(den) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if neg {
+		q.Neg(q)
+	}
+	return model.Money(q.Int64())
+}
+
+func currencyOf(s *model.Subscription) string {
+	if s.Currency == "" {
+		return model.BaseCurrency
+	}
+	return s.Currency
+}
+
+// SaveRates upserts exchange rates, e.g. parsed from an ECB CSV file
+func (p *PostgresRepo) SaveRates(rates []model.ExchangeRate) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	q := `INSERT INTO exchange_rates (date, currency, rate) VALUES ($1,$2,$3)
+	ON CONFLICT (currency, date) DO UPDATE SET rate=EXCLUDED.rate`
+	for _, r := range rates {
+		if _, err := tx.Exec(q, r.Date, r.Currency, r.Rate); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+)
+
+// MatchMode is how Filter.ServiceName is compared to service names
+type MatchMode string
+
+const (
+	MatchExact    MatchMode = "exact"
+	MatchPrefix   MatchMode = "prefix"
+	MatchContains MatchMode = "contains"
+	// trigram similarity of at least Filter.Similarity, needs pg_trgm
+	MatchFuzzy MatchMode = "fuzzy"
+)
+
+// DefaultSimilarity is the similarity threshold of fuzzy matching, as in pg_trgm
+const DefaultSimilarity = 0.3
+
+// ParseMatchMode parses a client supplied match mode; empty means MatchExact,
+// the default of the list and the spend queries alike
+func ParseMatchMode(s string) (MatchMode, error) {
+	switch m := MatchMode(s); m {
+	case "":
+		return MatchExact, nil
+	case MatchExact, MatchPrefix, MatchContains, MatchFuzzy:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown match mode %q, expected exact, prefix, contains or fuzzy", s)
+}
+
+// Filter selects subscriptions for List and the spend queries, so the same
+// filter always selects the same rows; the zero value selects all of them
+type Filter struct {
+	// owned by or shared with the user
+	UserID *uuid.UUID
+	// compared to the service according to Match: case-insensitively against
+	// every catalog alias of the service, or to the name as entered when CaseSensitive
+	ServiceName   *string
+	Match         MatchMode
+	CaseSensitive bool
+	// threshold of MatchFuzzy in (0, 1], DefaultSimilarity if zero
+	Similarity float64
+	// none of these services, compared like an exact ServiceName
+	ExcludeServices []string
+	// all of Tags and none of ExcludeTags
+	Tags        []string
+	ExcludeTags []string
+	// ISO 4217 code of the price
+	Currency *string
+	// price in its own currency, inclusive
+	PriceMin *model.Money
+	PriceMax *model.Money
+	// trial months between TrialEndFrom and TrialEndTo, inclusive
+	TrialEndFrom *time.Time
+	TrialEndTo   *time.Time
+	// active at some point of [ActiveFrom, ActiveTo]
+	ActiveFrom *time.Time
+	ActiveTo   *time.Time
+}
+
+// where renders the filter as a WHERE clause over subscriptions, numbering its
+// placeholders after the arguments already in args
+func (f Filter) where(args []interface{}) (string, []interface{}) {
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + itoa(len(args))
+	}
+	conds := []string{}
+	if f.ActiveFrom != nil {
+		conds = append(conds, `(end_date IS NULL OR end_date >= `+arg(*f.ActiveFrom)+`)`)
+	}
+	if f.ActiveTo != nil {
+		conds = append(conds, `start_date <= `+arg(*f.ActiveTo))
+	}
+	if f.UserID != nil {
+		p := arg(*f.UserID)
+		conds = append(conds, `(user_id = `+p+` OR id IN (SELECT subscription_id FROM subscription_members WHERE user_id = `+p+`))`)
+	}
+	if f.ServiceName != nil {
+		if f.CaseSensitive {
+			conds = append(conds, `service_name `+matchSQL(f.Match, *f.ServiceName, arg))
+		} else {
+			// aliases are stored normalized, see model.ServiceKey
+			conds = append(conds, `service_id IN (SELECT service_id FROM service_aliases WHERE alias `+matchSQL(f.Match, model.ServiceKey(*f.ServiceName), arg)+`)`)
+		}
+	}
+	for _, name := range f.ExcludeServices {
+		if f.CaseSensitive {
+			conds = append(conds, `service_name <> `+arg(name))
+		} else {
+			conds = append(conds, `service_id NOT IN (SELECT service_id FROM service_aliases WHERE alias = `+arg(model.ServiceKey(name))+`)`)
+		}
+	}
+	for _, t := range f.Tags {
+		conds = append(conds, `id IN (`+taggedSQL+arg(t)+`)`)
+	}
+	for _, t := range f.ExcludeTags {
+		conds = append(conds, `id NOT IN (`+taggedSQL+arg(t)+`)`)
+	}
+	if f.Currency != nil {
+		conds = append(conds, `currency = `+arg(*f.Currency))
+	}
+	if f.PriceMin != nil {
+		conds = append(conds, `price >= `+arg(*f.PriceMin))
+	}
+	if f.PriceMax != nil {
+		conds = append(conds, `price <= `+arg(*f.PriceMax))
+	}
+	if f.TrialEndFrom != nil {
+		conds = append(conds, `trial_end >= `+arg(*f.TrialEndFrom))
+	}
+	if f.TrialEndTo != nil {
+		conds = append(conds, `trial_end <= `+arg(*f.TrialEndTo))
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return ` WHERE ` + strings.Join(conds, ` AND `), args
+}
+
+const taggedSQL = `SELECT st.subscription_id FROM subscription_tags st JOIN tags t ON t.id = st.tag_id WHERE t.name = `
+
+// orderBy ranks fuzzy matches by similarity, best first; other filters leave
+// the order unspecified
+func (f Filter) orderBy(args []interface{}) (string, []interface{}) {
+	if f.Match != MatchFuzzy || f.ServiceName == nil {
+		return "", args
+	}
+	if f.CaseSensitive {
+		args = append(args, *f.ServiceName)
+		return ` ORDER BY similarity(service_name, $` + itoa(len(args)) + `) DESC, service_name`, args
+	}
+	args = append(args, model.ServiceKey(*f.ServiceName))
+	return ` ORDER BY (SELECT max(similarity(a.alias, $` + itoa(len(args)) + `)) FROM service_aliases a
+	WHERE a.service_id = subscriptions.service_id) DESC, service_name`, args
+}
+
+func (f Filter) similarity() float64 {
+	if f.Similarity == 0 {
+		return DefaultSimilarity
+	}
+	return f.Similarity
+}
+
+// matchSQL renders the comparison of a column with v for a match mode
+func matchSQL(m MatchMode, v string, arg func(interface{}) string) string {
+	switch m {
+	case MatchFuzzy:
+		// the threshold is pg_trgm.similarity_threshold, set by PostgresRepo.begin
+		return `% ` + arg(v)
+	case MatchPrefix:
+		return `LIKE ` + arg(likeEscaper.Replace(v)+"%")
+	case MatchContains:
+		return `LIKE ` + arg("%"+likeEscaper.Replace(v)+"%")
+	}
+	return `= ` + arg(v)
+}
+
+// spendFilter restricts f to subscriptions active in [from,to]
+func spendFilter(f Filter, from, to time.Time) Filter {
+	f.ActiveFrom, f.ActiveTo = &from, &to
+	return f
+}
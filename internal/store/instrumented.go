@@ -0,0 +1,254 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+)
+
+// Observer is told the duration and outcome of each repository call
+type Observer func(method string, d time.Duration, err error)
+
+// Instrument wraps r so that every call is reported to observe
+func Instrument(r Repository, observe Observer) Repository {
+	return &instrumented{next: r, observe: observe}
+}
+
+type instrumented struct {
+	next    Repository
+	observe Observer
+}
+
+func (i *instrumented) done(method string, start time.Time, err error) {
+	i.observe(method, time.Since(start), err)
+}
+
+func (i *instrumented) Create(sub *model.Subscription) error {
+	start := time.Now()
+	err := i.next.Create(sub)
+	i.done("Create", start, err)
+	return err
+}
+
+func (i *instrumented) Get(id uuid.UUID) (*model.Subscription, error) {
+	start := time.Now()
+	res, err := i.next.Get(id)
+	i.done("Get", start, err)
+	return res, err
+}
+
+func (i *instrumented) Update(sub *model.Subscription, priceFrom time.Time) error {
+	start := time.Now()
+	err := i.next.Update(sub, priceFrom)
+	i.done("Update", start, err)
+	return err
+}
+
+func (i *instrumented) Delete(id uuid.UUID) error {
+	start := time.Now()
+	err := i.next.Delete(id)
+	i.done("Delete", start, err)
+	return err
+}
+
+func (i *instrumented) List(f Filter) ([]model.Subscription, error) {
+	start := time.Now()
+	res, err := i.next.List(f)
+	i.done("List", start, err)
+	return res, err
+}
+
+func (i *instrumented) AggregateSum(f Filter, from, to time.Time, currency string) (model.Money, error) {
+	start := time.Now()
+	res, err := i.next.AggregateSum(f, from, to, currency)
+	i.done("AggregateSum", start, err)
+	return res, err
+}
+
+func (i *instrumented) ForecastSum(f Filter, from time.Time, months int, currency string) ([]model.Money, error) {
+	start := time.Now()
+	res, err := i.next.ForecastSum(f, from, months, currency)
+	i.done("ForecastSum", start, err)
+	return res, err
+}
+
+func (i *instrumented) Renewals(userID *uuid.UUID, from, to time.Time) ([]model.Renewal, error) {
+	start := time.Now()
+	res, err := i.next.Renewals(userID, from, to)
+	i.done("Renewals", start, err)
+	return res, err
+}
+
+func (i *instrumented) Pause(pause *model.Pause) error {
+	start := time.Now()
+	err := i.next.Pause(pause)
+	i.done("Pause", start, err)
+	return err
+}
+
+func (i *instrumented) Resume(subscriptionID uuid.UUID, month time.Time) error {
+	start := time.Now()
+	err := i.next.Resume(subscriptionID, month)
+	i.done("Resume", start, err)
+	return err
+}
+
+func (i *instrumented) ListPauses(subscriptionID uuid.UUID) ([]model.Pause, error) {
+	start := time.Now()
+	res, err := i.next.ListPauses(subscriptionID)
+	i.done("ListPauses", start, err)
+	return res, err
+}
+
+func (i *instrumented) ListPrices(subscriptionID uuid.UUID) ([]model.PricePoint, error) {
+	start := time.Now()
+	res, err := i.next.ListPrices(subscriptionID)
+	i.done("ListPrices", start, err)
+	return res, err
+}
+
+func (i *instrumented) SetMembers(subscriptionID uuid.UUID, split string, members []model.Member) error {
+	start := time.Now()
+	err := i.next.SetMembers(subscriptionID, split, members)
+	i.done("SetMembers", start, err)
+	return err
+}
+
+func (i *instrumented) ListMembers(subscriptionID uuid.UUID) ([]model.Member, error) {
+	start := time.Now()
+	res, err := i.next.ListMembers(subscriptionID)
+	i.done("ListMembers", start, err)
+	return res, err
+}
+
+func (i *instrumented) Settlement(userID *uuid.UUID, from, to time.Time, currency string) ([]model.Debt, error) {
+	start := time.Now()
+	res, err := i.next.Settlement(userID, from, to, currency)
+	i.done("Settlement", start, err)
+	return res, err
+}
+
+func (i *instrumented) AggregateByTag(f Filter, from, to time.Time, currency string) ([]model.CategoryTotal, error) {
+	start := time.Now()
+	res, err := i.next.AggregateByTag(f, from, to, currency)
+	i.done("AggregateByTag", start, err)
+	return res, err
+}
+
+func (i *instrumented) CreateBudget(b *model.Budget) error {
+	start := time.Now()
+	err := i.next.CreateBudget(b)
+	i.done("CreateBudget", start, err)
+	return err
+}
+
+func (i *instrumented) ListBudgets(userID uuid.UUID) ([]model.Budget, error) {
+	start := time.Now()
+	res, err := i.next.ListBudgets(userID)
+	i.done("ListBudgets", start, err)
+	return res, err
+}
+
+func (i *instrumented) DeleteBudget(id uuid.UUID) error {
+	start := time.Now()
+	err := i.next.DeleteBudget(id)
+	i.done("DeleteBudget", start, err)
+	return err
+}
+
+func (i *instrumented) FindService(name string) (*model.Service, error) {
+	start := time.Now()
+	res, err := i.next.FindService(name)
+	i.done("FindService", start, err)
+	return res, err
+}
+
+func (i *instrumented) SearchServices(query string, limit int) ([]model.Service, error) {
+	start := time.Now()
+	res, err := i.next.SearchServices(query, limit)
+	i.done("SearchServices", start, err)
+	return res, err
+}
+
+func (i *instrumented) CreateService(svc *model.Service) error {
+	start := time.Now()
+	err := i.next.CreateService(svc)
+	i.done("CreateService", start, err)
+	return err
+}
+
+func (i *instrumented) AddAliases(serviceID uuid.UUID, aliases []string) (*model.Service, error) {
+	start := time.Now()
+	res, err := i.next.AddAliases(serviceID, aliases)
+	i.done("AddAliases", start, err)
+	return res, err
+}
+
+func (i *instrumented) CreateAPIKey(k *model.APIKey) error {
+	start := time.Now()
+	err := i.next.CreateAPIKey(k)
+	i.done("CreateAPIKey", start, err)
+	return err
+}
+
+func (i *instrumented) ListAPIKeys() ([]model.APIKey, error) {
+	start := time.Now()
+	res, err := i.next.ListAPIKeys()
+	i.done("ListAPIKeys", start, err)
+	return res, err
+}
+
+func (i *instrumented) RevokeAPIKey(id uuid.UUID) error {
+	start := time.Now()
+	err := i.next.RevokeAPIKey(id)
+	i.done("RevokeAPIKey", start, err)
+	return err
+}
+
+func (i *instrumented) RotateAPIKey(id uuid.UUID, prefix string, hash []byte) (*model.APIKey, error) {
+	start := time.Now()
+	res, err := i.next.RotateAPIKey(id, prefix, hash)
+	i.done("RotateAPIKey", start, err)
+	return res, err
+}
+
+func (i *instrumented) FindAPIKey(prefix string) (*model.APIKey, error) {
+	start := time.Now()
+	res, err := i.next.FindAPIKey(prefix)
+	i.done("FindAPIKey", start, err)
+	return res, err
+}
+
+func (i *instrumented) TouchAPIKey(id uuid.UUID, at time.Time) error {
+	start := time.Now()
+	err := i.next.TouchAPIKey(id, at)
+	i.done("TouchAPIKey", start, err)
+	return err
+}
+
+func (i *instrumented) SetCalendarToken(userID uuid.UUID, hash []byte) error {
+	start := time.Now()
+	err := i.next.SetCalendarToken(userID, hash)
+	i.done("SetCalendarToken", start, err)
+	return err
+}
+
+func (i *instrumented) DeleteCalendarToken(userID uuid.UUID) error {
+	start := time.Now()
+	err := i.next.DeleteCalendarToken(userID)
+	i.done("DeleteCalendarToken", start, err)
+	return err
+}
+
+func (i *instrumented) FindCalendarToken(hash []byte) (uuid.UUID, error) {
+	start := time.Now()
+	res, err := i.next.FindCalendarToken(hash)
+	i.done("FindCalendarToken", start, err)
+	return res, err
+}
+
+func (i *instrumented) WithContext(ctx context.Context) Repository {
+	return &instrumented{next: i.next.WithContext(ctx), observe: i.observe}
+}
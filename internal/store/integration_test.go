@@ -1,17 +1,19 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
 	"time"
 
-	"github.com/ory/dockertest/v3"
-	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
 	"github.com/effectivemobile/subscriptions/internal/model"
 	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/ory/dockertest/v3"
 )
 
 func TestIntegration_Aggregate(t *testing.T) {
@@ -74,6 +76,9 @@ func runIntegrationAgainstDB(t *testing.T, db *sqlx.DB) {
 	}
 
 	repo := NewPostgresRepository(db, nil)
+	if err := repo.CheckSchema(context.Background()); err != nil {
+		t.Fatalf("schema check failed after migrations: %v", err)
+	}
 
 	// Prepare sample data
 	uid := uuid.New()
@@ -118,90 +123,130 @@ func runIntegrationAgainstDB(t *testing.T, db *sqlx.DB) {
 	from := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
 	to := time.Date(2025, 9, 30, 23, 59, 59, 0, time.UTC)
 
-	total, err := repo.AggregateSum(&uid, nil, from, to)
+	total, err := repo.AggregateSum(Filter{UserID: &uid}, from, to, model.BaseCurrency)
 	if err != nil {
 		t.Fatalf("aggregate failed: %v", err)
 	}
 	if total != 700 { // 300 + 400
-		t.Fatalf("expected total 700, got %d", total)
+		t.Fatalf("expected total 700, got %v", total)
+	}
+
+	// S2 got more expensive from August 2025 -> Jul 200 + Aug 300 = 500
+	s2.Price = 300
+	if err := repo.Update(s2, time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("failed update s2: %v", err)
+	}
+	total, err = repo.AggregateSum(Filter{UserID: &uid}, from, to, model.BaseCurrency)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	if total != 800 { // 300 + 500
+		t.Fatalf("expected total 800 after price change, got %v", total)
+	}
+
+	// names differing in case and spacing resolve to the same catalog service
+	s5 := &model.Subscription{
+		ServiceName: "  s1 ",
+		Price:       100,
+		UserID:      uuid.New(),
+		StartDate:   time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if err := repo.Create(s5); err != nil {
+		t.Fatalf("failed create s5: %v", err)
+	}
+	if s5.ServiceID == nil || *s5.ServiceID != *s1.ServiceID || s5.CanonicalName != "S1" {
+		t.Fatalf("expected s5 to reference service S1, got %v %q", s5.ServiceID, s5.CanonicalName)
+	}
+	// the name is kept as entered, the catalog name is read along with it
+	got, err := repo.Get(s5.ID)
+	if err != nil {
+		t.Fatalf("get s5 failed: %v", err)
+	}
+	if got.ServiceName != "  s1 " || got.CanonicalName != "S1" {
+		t.Fatalf("expected the entered name and the catalog name, got %q %q", got.ServiceName, got.CanonicalName)
 	}
 
 	// test filtering by service name
-	total2, err := repo.AggregateSum(nil, strPtr("S1"), from, to)
+	total2, err := repo.AggregateSum(Filter{ServiceName: strPtr("S1")}, from, to, model.BaseCurrency)
 	if err != nil {
 		t.Fatalf("aggregate failed: %v", err)
 	}
 	if total2 == 0 {
 		t.Fatalf("expected non-zero total for service S1, got 0")
 	}
-}
-	// Run migrations from EnsureMigrations
-	if err := EnsureMigrations(db); err != nil {
-		t.Fatalf("migration failed: %v", err)
+
+	// api keys are found by prefix until rotated or revoked
+	key := &model.APIKey{Name: "billing", Prefix: "0123456789ab", Hash: []byte{1, 2, 3}, Scopes: []string{model.ScopeRead}}
+	if err := repo.CreateAPIKey(key); err != nil {
+		t.Fatalf("create api key failed: %v", err)
+	}
+	found, err := repo.FindAPIKey(key.Prefix)
+	if err != nil || found.ID != key.ID || len(found.Scopes) != 1 || found.Scopes[0] != model.ScopeRead {
+		t.Fatalf("unexpected api key %+v: %v", found, err)
+	}
+	if _, err := repo.RotateAPIKey(key.ID, "ba9876543210", []byte{4}); err != nil {
+		t.Fatalf("rotate api key failed: %v", err)
+	}
+	if _, err := repo.FindAPIKey(key.Prefix); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected the old prefix to be gone, got %v", err)
+	}
+	if err := repo.RevokeAPIKey(key.ID); err != nil {
+		t.Fatalf("revoke api key failed: %v", err)
+	}
+	if _, err := repo.FindAPIKey("ba9876543210"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected a revoked key not to be found, got %v", err)
 	}
 
-	repo := NewPostgresRepository(db, nil)
+	runPausesAndTrials(t, repo)
+}
 
-	// Prepare sample data
+// runPausesAndTrials checks that paused and free months are not charged, on a
+// user of its own so that the scenario above keeps its totals
+func runPausesAndTrials(t *testing.T, repo *PostgresRepo) {
 	uid := uuid.New()
-	// active across Jul-Sep 2025, price 100 -> 3 months = 300
-	s1 := &model.Subscription{
-		ID:          uuid.New(),
-		ServiceName: "S1",
+	// active across Jul-Sep 2025 but paused for August, price 100 -> 2 paid months = 200
+	paused := &model.Subscription{
+		ServiceName: "Paused",
 		Price:       100,
 		UserID:      uid,
 		StartDate:   time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC),
-		EndDate:     nil,
 	}
-	if err := repo.Create(s1); err != nil {
-		t.Fatalf("failed create s1: %v", err)
+	if err := repo.Create(paused); err != nil {
+		t.Fatalf("failed create paused: %v", err)
 	}
-
-	// subscription that ends August 2025, price 200 -> Jul-Aug overlap with Jul-Sep = 2 months -> 400
-	s2 := &model.Subscription{
-		ID:          uuid.New(),
-		ServiceName: "S2",
-		Price:       200,
-		UserID:      uid,
-		StartDate:   time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
-		EndDate:     ptrTime(time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)),
+	if err := repo.Pause(&model.Pause{
+		SubscriptionID: paused.ID,
+		StartDate:      time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:        ptrTime(time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)),
+	}); err != nil {
+		t.Fatalf("failed pause: %v", err)
 	}
-	if err := repo.Create(s2); err != nil {
-		t.Fatalf("failed create s2: %v", err)
+	if err := repo.Pause(&model.Pause{SubscriptionID: paused.ID, StartDate: time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)}); err != ErrPauseOverlap {
+		t.Fatalf("expected overlapping pause to be rejected, got %v", err)
 	}
 
-	// different user - should be ignored when filtering
-	s3 := &model.Subscription{
-		ID:          uuid.New(),
-		ServiceName: "S3",
-		Price:       1000,
-		UserID:      uuid.New(),
-		StartDate:   time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC),
+	// free trial through August 2025, price 50 -> only September is paid -> 50
+	trial := &model.Subscription{
+		ServiceName: "Trial",
+		Price:       50,
+		UserID:      uid,
+		StartDate:   time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+		TrialEnd:    ptrTime(time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)),
 	}
-	if err := repo.Create(s3); err != nil {
-		t.Fatalf("failed create s3: %v", err)
+	if err := repo.Create(trial); err != nil {
+		t.Fatalf("failed create trial: %v", err)
 	}
 
 	from := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
 	to := time.Date(2025, 9, 30, 23, 59, 59, 0, time.UTC)
-
-	total, err := repo.AggregateSum(&uid, nil, from, to)
+	total, err := repo.AggregateSum(Filter{UserID: &uid}, from, to, model.BaseCurrency)
 	if err != nil {
 		t.Fatalf("aggregate failed: %v", err)
 	}
-	if total != 700 { // 300 + 400
-		t.Fatalf("expected total 700, got %d", total)
-	}
-
-	// test filtering by service name
-	total2, err := repo.AggregateSum(nil, strPtr("S1"), from, to)
-	if err != nil {
-		t.Fatalf("aggregate failed: %v", err)
-	}
-	if total2 == 0 {
-		t.Fatalf("expected non-zero total for service S1, got 0")
+	if total != 250 { // 200 + 50
+		t.Fatalf("expected total 250 without paused and trial months, got %v", total)
 	}
 }
 
 func ptrTime(t time.Time) *time.Time { return &t }
-func strPtr(s string) *string { return &s }
+func strPtr(s string) *string        { return &s }
@@ -1,32 +1,135 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/effectivemobile/subscriptions/internal/logging"
 	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/sirupsen/logrus"
-	"github.com/google/uuid"
 )
 
 type Repository interface {
 	Create(sub *model.Subscription) error
 	Get(id uuid.UUID) (*model.Subscription, error)
-	Update(sub *model.Subscription) error
+	Update(sub *model.Subscription, priceFrom time.Time) error
 	Delete(id uuid.UUID) error
-	List(filter map[string]interface{}) ([]model.Subscription, error)
-	AggregateSum(userID *uuid.UUID, serviceName *string, from, to time.Time) (int64, error)
+	List(f Filter) ([]model.Subscription, error)
+	AggregateSum(f Filter, from, to time.Time, currency string) (model.Money, error)
+	ForecastSum(f Filter, from time.Time, months int, currency string) ([]model.Money, error)
+	Renewals(userID *uuid.UUID, from, to time.Time) ([]model.Renewal, error)
+	Pause(pause *model.Pause) error
+	Resume(subscriptionID uuid.UUID, month time.Time) error
+	ListPauses(subscriptionID uuid.UUID) ([]model.Pause, error)
+	ListPrices(subscriptionID uuid.UUID) ([]model.PricePoint, error)
+	SetMembers(subscriptionID uuid.UUID, split string, members []model.Member) error
+	ListMembers(subscriptionID uuid.UUID) ([]model.Member, error)
+	Settlement(userID *uuid.UUID, from, to time.Time, currency string) ([]model.Debt, error)
+	AggregateByTag(f Filter, from, to time.Time, currency string) ([]model.CategoryTotal, error)
+	CreateBudget(b *model.Budget) error
+	ListBudgets(userID uuid.UUID) ([]model.Budget, error)
+	DeleteBudget(id uuid.UUID) error
+	FindService(name string) (*model.Service, error)
+	SearchServices(query string, limit int) ([]model.Service, error)
+	CreateService(svc *model.Service) error
+	AddAliases(serviceID uuid.UUID, aliases []string) (*model.Service, error)
+	CreateAPIKey(k *model.APIKey) error
+	ListAPIKeys() ([]model.APIKey, error)
+	RevokeAPIKey(id uuid.UUID) error
+	RotateAPIKey(id uuid.UUID, prefix string, hash []byte) (*model.APIKey, error)
+	FindAPIKey(prefix string) (*model.APIKey, error)
+	TouchAPIKey(id uuid.UUID, at time.Time) error
+	SetCalendarToken(userID uuid.UUID, hash []byte) error
+	DeleteCalendarToken(userID uuid.UUID) error
+	FindCalendarToken(hash []byte) (uuid.UUID, error)
+	// WithContext returns the repository running its queries under ctx, which
+	// cancels them and traces each one as a child of the span of ctx; they are
+	// logged at debug level with the logger of the request
+	WithContext(ctx context.Context) Repository
 }
 
+const subscriptionColumns = `id,service_name,service_id,price,user_id,start_date,end_date,billing_day,trial_end,currency,discount,split,` +
+	`COALESCE((SELECT name FROM services WHERE services.id = subscriptions.service_id), service_name) AS canonical_name`
+
+// columns needed to compute spend
+const spendColumns = `id,price,user_id,start_date,end_date,trial_end,currency,discount,split`
+
+var (
+	ErrPauseOverlap = errors.New("pause overlaps an existing pause")
+	ErrNotPaused    = errors.New("subscription is not paused")
+)
+
 type PostgresRepo struct {
-	db  *sqlx.DB
-	log *logrus.Logger
+	db *tracedDB
+	// pg_trgm is installed, otherwise fuzzy matching falls back to contains
+	trgm bool
 }
 
 func NewPostgresRepository(db *sqlx.DB, log *logrus.Logger) *PostgresRepo {
-	return &PostgresRepo{db: db, log: log}
+	p := &PostgresRepo{db: &tracedDB{DB: db, bound: bound{ctx: context.Background()}}}
+	if log != nil {
+		p.db.log = logrus.NewEntry(log)
+	}
+	err := db.Get(&p.trgm, `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm')`)
+	if log != nil {
+		if err != nil {
+			log.Warnf("could not check for pg_trgm: %v", err)
+		} else if !p.trgm {
+			log.Warn("pg_trgm is not installed, fuzzy service search falls back to substring matching")
+		}
+	}
+	return p
+}
+
+func (p *PostgresRepo) WithContext(ctx context.Context) Repository {
+	b := bound{ctx: ctx, log: p.db.log}
+	if l, ok := logging.FromContext(ctx); ok {
+		b.log = l
+	}
+	c := *p
+	c.db = &tracedDB{DB: p.db.DB, bound: b}
+	return &c
+}
+
+// filter adapts f to the database: without pg_trgm fuzzy matching becomes contains
+func (p *PostgresRepo) filter(f Filter) Filter {
+	if f.Match == MatchFuzzy && !p.trgm {
+		f.Match = MatchContains
+	}
+	return f
+}
+
+// begin starts a transaction for the queries of f, setting the similarity
+// threshold of fuzzy matching for its duration
+func (p *PostgresRepo) begin(f Filter) (*tracedTx, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	if f.Match == MatchFuzzy && f.ServiceName != nil {
+		threshold := strconv.FormatFloat(f.similarity(), 'f', -1, 64)
+		if _, err := tx.Exec(`SELECT set_config('pg_trgm.similarity_threshold', $1, true)`, threshold); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// tables EnsureMigrations creates, CheckSchema expects all of them
+var schemaTables = []string{
+	"subscriptions", "subscription_members", "tags", "subscription_tags", "budgets", "exchange_rates",
+	"subscription_pauses", "subscription_prices", "services", "service_aliases", "api_keys",
+	"calendar_tokens",
 }
 
 func EnsureMigrations(db *sqlx.DB) error {
@@ -36,12 +139,134 @@ func EnsureMigrations(db *sqlx.DB) error {
 		`CREATE TABLE IF NOT EXISTS subscriptions (
 			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
 			service_name TEXT NOT NULL,
-			price INTEGER NOT NULL,
+			price BIGINT NOT NULL,
 			user_id UUID NOT NULL,
 			start_date DATE NOT NULL,
 			end_date DATE
 		);`,
 		`CREATE INDEX IF NOT EXISTS idx_subscriptions_user ON subscriptions(user_id);`,
+		`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS billing_day SMALLINT NOT NULL DEFAULT 1 CHECK (billing_day BETWEEN 1 AND 31);`,
+		`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS trial_end DATE;`,
+		`CREATE INDEX IF NOT EXISTS idx_subscriptions_trial_end ON subscriptions(trial_end) WHERE trial_end IS NOT NULL;`,
+		// prices used to be whole rubles, convert them to kopecks exactly once
+		`DO $$
+		BEGIN
+			IF (SELECT data_type FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = 'subscriptions' AND column_name = 'price') = 'integer' THEN
+				ALTER TABLE subscriptions ALTER COLUMN price TYPE BIGINT USING price * 100;
+				IF to_regclass('subscription_prices') IS NOT NULL THEN
+					ALTER TABLE subscription_prices ALTER COLUMN price TYPE BIGINT USING price * 100;
+				END IF;
+			END IF;
+		END $$;`,
+		`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'RUB';`,
+		`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS discount JSONB;`,
+		`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS split TEXT NOT NULL DEFAULT 'equal' CHECK (split IN ('equal', 'percent', 'fixed'));`,
+		`CREATE TABLE IF NOT EXISTS subscription_members (
+			subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL,
+			percent SMALLINT CHECK (percent BETWEEN 1 AND 100),
+			amount BIGINT CHECK (amount >= 0),
+			PRIMARY KEY (subscription_id, user_id)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_subscription_members_user ON subscription_members(user_id);`,
+		`CREATE TABLE IF NOT EXISTS tags (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			name TEXT NOT NULL UNIQUE
+		);`,
+		`CREATE TABLE IF NOT EXISTS subscription_tags (
+			subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+			tag_id UUID NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+			PRIMARY KEY (subscription_id, tag_id)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_subscription_tags_tag ON subscription_tags(tag_id);`,
+		`CREATE TABLE IF NOT EXISTS budgets (
+			id UUID PRIMARY KEY,
+			user_id UUID NOT NULL,
+			category TEXT,
+			service_name TEXT,
+			amount BIGINT NOT NULL CHECK (amount > 0),
+			currency CHAR(3) NOT NULL DEFAULT 'RUB',
+			CHECK (category IS NULL OR service_name IS NULL)
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_budgets_scope ON budgets(user_id, COALESCE(category, ''), COALESCE(service_name, ''));`,
+		`CREATE TABLE IF NOT EXISTS exchange_rates (
+			date DATE NOT NULL,
+			currency CHAR(3) NOT NULL,
+			rate NUMERIC(18,6) NOT NULL CHECK (rate > 0),
+			PRIMARY KEY (currency, date)
+		);`,
+		`CREATE TABLE IF NOT EXISTS subscription_pauses (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+			start_date DATE NOT NULL,
+			end_date DATE,
+			CHECK (end_date IS NULL OR end_date >= start_date)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_subscription_pauses_subscription ON subscription_pauses(subscription_id);`,
+		`CREATE TABLE IF NOT EXISTS subscription_prices (
+			subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+			effective_from DATE NOT NULL,
+			price BIGINT NOT NULL,
+			PRIMARY KEY (subscription_id, effective_from)
+		);`,
+		// subscriptions created before price schedules start with their current price
+		`INSERT INTO subscription_prices (subscription_id, effective_from, price)
+			SELECT id, start_date, price FROM subscriptions s
+			WHERE NOT EXISTS (SELECT 1 FROM subscription_prices p WHERE p.subscription_id = s.id);`,
+		`CREATE TABLE IF NOT EXISTS services (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			name TEXT NOT NULL UNIQUE,
+			default_price BIGINT CHECK (default_price >= 0),
+			currency CHAR(3) NOT NULL DEFAULT 'RUB'
+		);`,
+		// normalized names (see model.ServiceKey) a service is found by
+		`CREATE TABLE IF NOT EXISTS service_aliases (
+			alias TEXT PRIMARY KEY,
+			service_id UUID NOT NULL REFERENCES services(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_service_aliases_service ON service_aliases(service_id);`,
+		`ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS service_id UUID REFERENCES services(id);`,
+		`CREATE INDEX IF NOT EXISTS idx_subscriptions_service ON subscriptions(service_id);`,
+		// backfill: one service per normalized name of existing subscriptions
+		`INSERT INTO services (name)
+			SELECT min(btrim(service_name)) FROM subscriptions s
+			WHERE s.service_id IS NULL AND NOT EXISTS (SELECT 1 FROM service_aliases a WHERE a.alias = ` + serviceKeySQL("s.service_name") + `)
+			GROUP BY ` + serviceKeySQL("s.service_name") + `
+			ON CONFLICT (name) DO NOTHING;`,
+		`INSERT INTO service_aliases (alias, service_id) SELECT ` + serviceKeySQL("name") + `, id FROM services ON CONFLICT DO NOTHING;`,
+		`UPDATE subscriptions s SET service_id = a.service_id
+			FROM service_aliases a
+			WHERE s.service_id IS NULL AND a.alias = ` + serviceKeySQL("s.service_name") + `;`,
+		// fuzzy search is optional, installing pg_trgm may need privileges the service lacks
+		`DO $$
+		BEGIN
+			CREATE EXTENSION IF NOT EXISTS pg_trgm;
+		EXCEPTION WHEN OTHERS THEN
+			RAISE NOTICE 'pg_trgm is not available: %', SQLERRM;
+		END $$;`,
+		`DO $$
+		BEGIN
+			IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm') THEN
+				CREATE INDEX IF NOT EXISTS idx_service_aliases_trgm ON service_aliases USING gin (alias gin_trgm_ops);
+				CREATE INDEX IF NOT EXISTS idx_subscriptions_service_name_trgm ON subscriptions USING gin (service_name gin_trgm_ops);
+			END IF;
+		END $$;`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id UUID PRIMARY KEY,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL UNIQUE,
+			hash BYTEA NOT NULL,
+			scopes TEXT[] NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			last_used_at TIMESTAMPTZ,
+			revoked_at TIMESTAMPTZ
+		);`,
+		`CREATE TABLE IF NOT EXISTS calendar_tokens (
+			user_id UUID PRIMARY KEY,
+			hash BYTEA NOT NULL UNIQUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);`,
 	}
 	for _, q := range queries {
 		if _, err := db.Exec(q); err != nil {
@@ -52,28 +277,94 @@ func EnsureMigrations(db *sqlx.DB) error {
 }
 
 func (p *PostgresRepo) Create(sub *model.Subscription) error {
-	q := `INSERT INTO subscriptions (id, service_name, price, user_id, start_date, end_date)
-	VALUES ($1,$2,$3,$4,$5,$6)`
+	q := `INSERT INTO subscriptions (id, service_name, price, user_id, start_date, end_date, billing_day, trial_end, currency, discount, service_id)
+	VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)`
 	if sub.ID == uuid.Nil {
 		sub.ID = uuid.New()
 	}
-	_, err := p.db.Exec(q, sub.ID, sub.ServiceName, sub.Price, sub.UserID, sub.StartDate, sub.EndDate)
-	return err
+	if sub.BillingDay == 0 {
+		sub.BillingDay = 1
+	}
+	sub.Currency = currencyOf(sub)
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := resolveService(tx, sub); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(q, sub.ID, sub.ServiceName, sub.Price, sub.UserID, sub.StartDate, sub.EndDate, sub.BillingDay, sub.TrialEnd, sub.Currency, sub.Discount, sub.ServiceID); err != nil {
+		return err
+	}
+	// the price schedule starts with the initial price
+	if err := setPrice(tx, sub.ID, sub.StartDate, sub.Price); err != nil {
+		return err
+	}
+	if err := setTags(tx, sub.ID, sub.Tags); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (p *PostgresRepo) Get(id uuid.UUID) (*model.Subscription, error) {
 	var s model.Subscription
-	q := `SELECT id,service_name,price,user_id,start_date,end_date FROM subscriptions WHERE id=$1`
+	q := `SELECT ` + subscriptionColumns + ` FROM subscriptions WHERE id=$1`
 	if err := p.db.Get(&s, q, id); err != nil {
 		return nil, err
 	}
+	tags, err := tagsFor(p.db, []model.Subscription{s})
+	if err != nil {
+		return nil, err
+	}
+	s.Tags = tags[s.ID]
 	return &s, nil
 }
 
-func (p *PostgresRepo) Update(sub *model.Subscription) error {
-	q := `UPDATE subscriptions SET service_name=$1, price=$2, user_id=$3, start_date=$4, end_date=$5 WHERE id=$6`
-	_, err := p.db.Exec(q, sub.ServiceName, sub.Price, sub.UserID, sub.StartDate, sub.EndDate, sub.ID)
-	return err
+// Update overwrites the subscription; a changed price starts a new segment of
+// the price schedule from priceFrom instead of rewriting past months
+func (p *PostgresRepo) Update(sub *model.Subscription, priceFrom time.Time) error {
+	q := `UPDATE subscriptions SET service_name=$1, price=$2, user_id=$3, start_date=$4, end_date=$5, billing_day=$6, trial_end=$7, currency=$8, discount=$9, service_id=$10 WHERE id=$11`
+	if sub.BillingDay == 0 {
+		sub.BillingDay = 1
+	}
+	sub.Currency = currencyOf(sub)
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := resolveService(tx, sub); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(q, sub.ServiceName, sub.Price, sub.UserID, sub.StartDate, sub.EndDate, sub.BillingDay, sub.TrialEnd, sub.Currency, sub.Discount, sub.ServiceID, sub.ID); err != nil {
+		return err
+	}
+	prices, err := pricesFor(tx, []model.Subscription{*sub})
+	if err != nil {
+		return err
+	}
+	if schedule := prices[sub.ID]; len(schedule) == 0 || priceAt(schedule, sub.Price, priceFrom) != sub.Price {
+		if err := setPrice(tx, sub.ID, firstOfMonth(priceFrom), sub.Price); err != nil {
+			return err
+		}
+	}
+	// tags are kept unless the update sets them
+	if sub.Tags != nil {
+		if err := setTags(tx, sub.ID, sub.Tags); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresRepo) ListPrices(subscriptionID uuid.UUID) ([]model.PricePoint, error) {
+	q := `SELECT subscription_id, effective_from, price FROM subscription_prices WHERE subscription_id=$1 ORDER BY effective_from`
+	prices := []model.PricePoint{}
+	if err := p.db.Select(&prices, q, subscriptionID); err != nil {
+		return nil, err
+	}
+	return prices, nil
 }
 
 func (p *PostgresRepo) Delete(id uuid.UUID) error {
@@ -82,79 +373,236 @@ func (p *PostgresRepo) Delete(id uuid.UUID) error {
 	return err
 }
 
-func (p *PostgresRepo) List(filter map[string]interface{}) ([]model.Subscription, error) {
-	q := `SELECT id,service_name,price,user_id,start_date,end_date FROM subscriptions WHERE 1=1`
-	args := []interface{}{}
-	idx := 1
-	if v, ok := filter["user_id"]; ok {
-		q += ` AND user_id=$` + itoa(idx)
-		args = append(args, v)
-		idx++
-	}
-	if v, ok := filter["service_name"]; ok {
-		q += ` AND service_name ILIKE $` + itoa(idx)
-		args = append(args, "%"+v.(string)+"%")
-		idx++
+func (p *PostgresRepo) List(f Filter) ([]model.Subscription, error) {
+	f = p.filter(f)
+	where, args := f.where(nil)
+	order, args := f.orderBy(args)
+	tx, err := p.begin(f)
+	if err != nil {
+		return nil, err
 	}
+	defer tx.Rollback()
 	var rows []model.Subscription
-	if err := p.db.Select(&rows, q, args...); err != nil {
+	if err := tx.Select(&rows, `SELECT `+subscriptionColumns+` FROM subscriptions`+where+order, args...); err != nil {
 		return nil, err
 	}
+	tags, err := tagsFor(tx, rows)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		rows[i].Tags = tags[rows[i].ID]
+	}
 	return rows, nil
 }
 
-func (p *PostgresRepo) AggregateSum(userID *uuid.UUID, serviceName *string, from, to time.Time) (int64, error) {
-	// sum months * price for subscriptions overlapping [from,to]
-	// For each subscription: overlap months = months_between(min(end or to), max(start,from)) + 1
-	q := `SELECT price, start_date, end_date FROM subscriptions WHERE (end_date IS NULL OR end_date >= $1) AND start_date <= $2`
-	args := []interface{}{from, to}
-	if userID != nil {
-		q += ` AND user_id = $3`
-		args = append(args, *userID)
-	}
-	if serviceName != nil {
-		q += ` AND service_name = $4`
-		args = append(args, *serviceName)
+// AggregateSum sums the monthly charges of the subscriptions f selects over [from,to]
+func (p *PostgresRepo) AggregateSum(f Filter, from, to time.Time, currency string) (model.Money, error) {
+	f = p.filter(f)
+	tx, err := p.begin(f)
+	if err != nil {
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	tx, err := p.db.Beginx()
+	where, args := spendFilter(f, from, to).where(nil)
+	var subs []model.Subscription
+	if err := tx.Select(&subs, `SELECT `+spendColumns+` FROM subscriptions`+where, args...); err != nil {
+		return 0, err
+	}
+	from = firstOfMonth(from)
+	months, err := spend(tx, subs, from, monthsInclusive(from, to), currency, f.UserID)
 	if err != nil {
 		return 0, err
 	}
+	var total model.Money
+	for _, m := range months {
+		total += m
+	}
+	return total, nil
+}
+
+func (p *PostgresRepo) ForecastSum(f Filter, from time.Time, months int, currency string) ([]model.Money, error) {
+	// projected spend per month for [from, from+months), one charge per active month
+	if months <= 0 {
+		return []model.Money{}, nil
+	}
+	f = p.filter(f)
+	tx, err := p.begin(f)
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Rollback()
+	where, args := spendFilter(f, from, from.AddDate(0, months, -1)).where(nil)
+	var subs []model.Subscription
+	if err := tx.Select(&subs, `SELECT `+spendColumns+` FROM subscriptions`+where, args...); err != nil {
+		return nil, err
+	}
+	return spend(tx, subs, from, months, currency, f.UserID)
+}
 
-	type row struct {
-		Price     int       `db:"price"`
-		StartDate time.Time `db:"start_date"`
-		EndDate   sql.NullTime `db:"end_date"`
+// spend returns the monthly charges of subs for the months starting at from:
+// trial and paused months are free, the rest is charged at the price in effect
+// that month after discounts, converted to currency; with user set only that
+// user's share of shared subscriptions is counted
+func spend(q sqlx.Queryer, subs []model.Subscription, from time.Time, months int, currency string, user *uuid.UUID) ([]model.Money, error) {
+	totals := make([]model.Money, months)
+	if len(subs) == 0 || months <= 0 {
+		return totals, nil
 	}
-	var total int64
-	var rrow row
-	rows, err := tx.Queryx(q, args...)
+	pauses, err := pausesFor(q, subs)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	for rows.Next() {
-		if err := rows.StructScan(&rrow); err != nil {
-			return 0, err
-		}
-		s := rrow.StartDate
-		e := rrow.EndDate
-		if e.Valid && e.Time.Before(from) { // finished before period
+	prices, err := pricesFor(q, subs)
+	if err != nil {
+		return nil, err
+	}
+	members, err := membersFor(q, subs)
+	if err != nil {
+		return nil, err
+	}
+	conv, err := loadConverter(q, currency, subs, from, from.AddDate(0, months, -1))
+	if err != nil {
+		return nil, err
+	}
+	for i := range subs {
+		sub := &subs[i]
+		if user == nil {
+			if err := spreadMonthly(totals, from, sub, pauses[sub.ID], prices[sub.ID], conv); err != nil {
+				return nil, err
+			}
 			continue
 		}
-		start := maxTime(s, from)
-		end := to
-		if e.Valid && e.Time.Before(to) {
-			end = e.Time
+		err := spreadShares(months, from, sub, pauses[sub.ID], prices[sub.ID], members[sub.ID], conv, func(m int, u uuid.UUID, share model.Money) {
+			if u == *user {
+				totals[m] += share
+			}
+		})
+		if err != nil {
+			return nil, err
 		}
-		months := monthsInclusive(start, end)
-		if months <= 0 {
+	}
+	return totals, nil
+}
+
+func (p *PostgresRepo) Renewals(userID *uuid.UUID, from, to time.Time) ([]model.Renewal, error) {
+	// subscriptions are monthly, so anything active in the months of [from,to] may renew
+	q := `SELECT ` + subscriptionColumns + ` FROM subscriptions WHERE (end_date IS NULL OR end_date >= $1) AND start_date <= $2`
+	args := []interface{}{firstOfMonth(from), to}
+	if userID != nil {
+		args = append(args, *userID)
+		q += ` AND user_id = $` + itoa(len(args))
+	}
+	var subs []model.Subscription
+	if err := p.db.Select(&subs, q, args...); err != nil {
+		return nil, err
+	}
+	pauses, err := pausesFor(p.db, subs)
+	if err != nil {
+		return nil, err
+	}
+	res := []model.Renewal{}
+	for _, s := range subs {
+		d, ok := nextRenewal(s.BillingStart(), s.EndDate, s.BillingDay, from)
+		// nothing is charged in paused months
+		for ok && !d.After(to) && pausedIn(pauses[s.ID], d) {
+			d, ok = nextRenewal(s.BillingStart(), s.EndDate, s.BillingDay, firstOfMonth(d).AddDate(0, 1, 0))
+		}
+		if !ok || d.After(to) {
 			continue
 		}
-		total += int64(months * rrow.Price)
+		res = append(res, model.Renewal{Subscription: s, RenewalDate: d})
 	}
-	return total, nil
+	sort.SliceStable(res, func(i, j int) bool { return res[i].RenewalDate.Before(res[j].RenewalDate) })
+	return res, nil
+}
+
+func (p *PostgresRepo) Pause(pause *model.Pause) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// serialize pauses of the same subscription so the overlap check holds
+	if _, err := tx.Exec(`SELECT id FROM subscriptions WHERE id=$1 FOR UPDATE`, pause.SubscriptionID); err != nil {
+		return err
+	}
+	var overlapping int
+	q := `SELECT count(*) FROM subscription_pauses WHERE subscription_id=$1
+	AND (end_date IS NULL OR end_date >= $2) AND ($3::date IS NULL OR start_date <= $3)`
+	if err := tx.Get(&overlapping, q, pause.SubscriptionID, pause.StartDate, pause.EndDate); err != nil {
+		return err
+	}
+	if overlapping > 0 {
+		return ErrPauseOverlap
+	}
+	if pause.ID == uuid.Nil {
+		pause.ID = uuid.New()
+	}
+	q = `INSERT INTO subscription_pauses (id, subscription_id, start_date, end_date) VALUES ($1,$2,$3,$4)`
+	if _, err := tx.Exec(q, pause.ID, pause.SubscriptionID, pause.StartDate, pause.EndDate); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresRepo) Resume(subscriptionID uuid.UUID, month time.Time) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var open model.Pause
+	q := `SELECT id, subscription_id, start_date, end_date FROM subscription_pauses WHERE subscription_id=$1 AND end_date IS NULL FOR UPDATE`
+	if err := tx.Get(&open, q, subscriptionID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotPaused
+		}
+		return err
+	}
+	// the resume month is paid again, so the pause ends the month before;
+	// a pause resumed in its first month never took effect and is dropped
+	last := firstOfMonth(month).AddDate(0, -1, 0)
+	if last.Before(open.StartDate) {
+		_, err = tx.Exec(`DELETE FROM subscription_pauses WHERE id=$1`, open.ID)
+	} else {
+		_, err = tx.Exec(`UPDATE subscription_pauses SET end_date=$1 WHERE id=$2`, last, open.ID)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresRepo) ListPauses(subscriptionID uuid.UUID) ([]model.Pause, error) {
+	q := `SELECT id, subscription_id, start_date, end_date FROM subscription_pauses WHERE subscription_id=$1 ORDER BY start_date`
+	pauses := []model.Pause{}
+	if err := p.db.Select(&pauses, q, subscriptionID); err != nil {
+		return nil, err
+	}
+	return pauses, nil
+}
+
+// pausesFor loads the pause intervals of subs keyed by subscription id
+func pausesFor(q sqlx.Queryer, subs []model.Subscription) (map[uuid.UUID][]model.Pause, error) {
+	res := map[uuid.UUID][]model.Pause{}
+	if len(subs) == 0 {
+		return res, nil
+	}
+	ids := make([]string, 0, len(subs))
+	for _, s := range subs {
+		ids = append(ids, s.ID.String())
+	}
+	var pauses []model.Pause
+	err := sqlx.Select(q, &pauses, `SELECT id, subscription_id, start_date, end_date FROM subscription_pauses WHERE subscription_id = ANY($1::uuid[])`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, ps := range pauses {
+		res[ps.SubscriptionID] = append(res[ps.SubscriptionID], ps)
+	}
+	return res, nil
 }
 
 // helpers
@@ -177,3 +625,152 @@ func monthsInclusive(a, b time.Time) int {
 	y2, m2, _ := b.Date()
 	return (y2-y1)*12 + int(m2-m1) + 1
 }
+
+// spreadMonthly adds the monthly charge of sub after its discount, converted by
+// conv, to every month of totals (starting at from) in which it is active, past
+// its trial and not paused
+func spreadMonthly(totals []model.Money, from time.Time, sub *model.Subscription, pauses []model.Pause, prices []model.PricePoint, conv *converter) error {
+	to := from.AddDate(0, len(totals), -1)
+	last := to
+	if sub.EndDate != nil && sub.EndDate.Before(to) {
+		last = *sub.EndDate
+	}
+	first := maxTime(sub.BillingStart(), from)
+	offset := monthsInclusive(from, first) - 1
+	for i := 0; i < monthsInclusive(first, last); i++ {
+		month := first.AddDate(0, i, 0)
+		if pausedIn(pauses, month) {
+			continue
+		}
+		// discounts limited to the first months count from the first paid month
+		price := sub.Discount.Apply(priceAt(prices, sub.Price, month), monthsInclusive(sub.BillingStart(), month)-1)
+		amount, err := conv.convert(price, currencyOf(sub), month)
+		if err != nil {
+			return err
+		}
+		totals[offset+i] += amount
+	}
+	return nil
+}
+
+func firstOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// chargeDate is the billing day within the month of t, clamped to the last day of that month
+func chargeDate(t time.Time, billingDay int) time.Time {
+	first := firstOfMonth(t)
+	if last := first.AddDate(0, 1, -1).Day(); billingDay > last {
+		billingDay = last
+	}
+	return first.AddDate(0, 0, billingDay-1)
+}
+
+// nextRenewal returns the first charge date on or after from for a monthly
+// subscription billed on billingDay, ok is false if it has already ended
+func nextRenewal(start time.Time, end *time.Time, billingDay int, from time.Time) (time.Time, bool) {
+	if billingDay < 1 {
+		billingDay = 1
+	}
+	month := maxTime(firstOfMonth(start), firstOfMonth(from))
+	d := chargeDate(month, billingDay)
+	if d.Before(from) {
+		d = chargeDate(month.AddDate(0, 1, 0), billingDay)
+	}
+	if end != nil && firstOfMonth(d).After(firstOfMonth(*end)) {
+		return time.Time{}, false
+	}
+	return d, true
+}
+
+// pausedIn reports whether the month of t falls into one of the pauses
+func pausedIn(pauses []model.Pause, t time.Time) bool {
+	month := firstOfMonth(t)
+	for _, ps := range pauses {
+		if !month.Before(ps.StartDate) && (ps.EndDate == nil || !month.After(*ps.EndDate)) {
+			return true
+		}
+	}
+	return false
+}
+
+// priceAt returns the price in effect in the month of t from a schedule sorted
+// by effective_from: the latest segment starting on or before it, else the first
+// one; base is used when there is no schedule
+func priceAt(prices []model.PricePoint, base model.Money, t time.Time) model.Money {
+	if len(prices) == 0 {
+		return base
+	}
+	month := firstOfMonth(t)
+	price := prices[0].Price
+	for _, pp := range prices {
+		if pp.EffectiveFrom.After(month) {
+			break
+		}
+		price = pp.Price
+	}
+	return price
+}
+
+// pricesFor loads the price schedules of subs keyed by subscription id
+func pricesFor(q sqlx.Queryer, subs []model.Subscription) (map[uuid.UUID][]model.PricePoint, error) {
+	res := map[uuid.UUID][]model.PricePoint{}
+	if len(subs) == 0 {
+		return res, nil
+	}
+	ids := make([]string, 0, len(subs))
+	for _, s := range subs {
+		ids = append(ids, s.ID.String())
+	}
+	var prices []model.PricePoint
+	err := sqlx.Select(q, &prices, `SELECT subscription_id, effective_from, price FROM subscription_prices WHERE subscription_id = ANY($1::uuid[]) ORDER BY effective_from`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, pp := range prices {
+		res[pp.SubscriptionID] = append(res[pp.SubscriptionID], pp)
+	}
+	return res, nil
+}
+
+func setPrice(e sqlx.Execer, subscriptionID uuid.UUID, from time.Time, price model.Money) error {
+	q := `INSERT INTO subscription_prices (subscription_id, effective_from, price) VALUES ($1,$2,$3)
+	ON CONFLICT (subscription_id, effective_from) DO UPDATE SET price=EXCLUDED.price`
+	_, err := e.Exec(q, subscriptionID, from, price)
+	return err
+}
+
+// Ping checks that the database is reachable
+func (p *PostgresRepo) Ping(ctx context.Context) error {
+	return p.db.PingContext(ctx)
+}
+
+// CheckSchema returns an error naming the tables the migrations should have created but are missing
+func (p *PostgresRepo) CheckSchema(ctx context.Context) error {
+	var missing []string
+	// unqualified names resolve through the search_path, like the queries of the service
+	q := `SELECT t FROM unnest($1::text[]) t WHERE to_regclass(t) IS NULL`
+	if err := p.db.SelectContext(ctx, &missing, q, pq.Array(schemaTables)); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("migrations not applied, missing tables: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// ActiveCurrencies returns the currencies of the subscriptions running in the month of at
+func (p *PostgresRepo) ActiveCurrencies(at time.Time) ([]string, error) {
+	var res []string
+	month := firstOfMonth(at)
+	err := p.db.Select(&res, `SELECT DISTINCT currency FROM subscriptions WHERE start_date <= $1 AND (end_date IS NULL OR end_date >= $1) ORDER BY currency`, month)
+	return res, err
+}
+
+// CountActive counts the subscriptions running in the month of at, trials and pauses included
+func (p *PostgresRepo) CountActive(at time.Time) (int, error) {
+	var n int
+	month := firstOfMonth(at)
+	err := p.db.Get(&n, `SELECT count(*) FROM subscriptions WHERE start_date <= $1 AND (end_date IS NULL OR end_date >= $1)`, month)
+	return n, err
+}
@@ -1,8 +1,13 @@
 package store
 
 import (
+	"errors"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
 )
 
 func TestMonthsInclusive(t *testing.T) {
@@ -27,3 +32,308 @@ func TestMonthsInclusive(t *testing.T) {
 		})
 	}
 }
+
+func TestSpreadMonthly(t *testing.T) {
+	from := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+	totals := make([]model.Money, 4) // Jul-Oct 2025
+
+	// started before the window, still active
+	spreadMonthly(totals, from, &model.Subscription{Price: 100, StartDate: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}, nil, nil, nil)
+	// starts in August, ends in September
+	end := time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)
+	spreadMonthly(totals, from, &model.Subscription{Price: 10, StartDate: time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC), EndDate: &end}, nil, nil, nil)
+	// starts after the window
+	spreadMonthly(totals, from, &model.Subscription{Price: 1000, StartDate: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}, nil, nil, nil)
+
+	want := []model.Money{100, 110, 110, 100}
+	for i := range want {
+		if totals[i] != want[i] {
+			t.Fatalf("totals = %v; want %v", totals, want)
+		}
+	}
+}
+
+func TestSpreadMonthly_PausesAndPrices(t *testing.T) {
+	date := func(y int, m time.Month) time.Time { return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC) }
+	from := date(2025, 7)
+	totals := make([]model.Money, 4) // Jul-Oct 2025
+	aug := date(2025, 8)
+	sub := &model.Subscription{Price: 300, StartDate: date(2025, 1)}
+	pauses := []model.Pause{{StartDate: aug, EndDate: &aug}}
+	prices := []model.PricePoint{
+		{EffectiveFrom: date(2025, 1), Price: 200},
+		{EffectiveFrom: date(2025, 9), Price: 250},
+		{EffectiveFrom: date(2025, 10), Price: 300},
+	}
+
+	spreadMonthly(totals, from, sub, pauses, prices, nil)
+
+	want := []model.Money{200, 0, 250, 300}
+	for i := range want {
+		if totals[i] != want[i] {
+			t.Fatalf("totals = %v; want %v", totals, want)
+		}
+	}
+}
+
+func TestSpreadMonthly_Discount(t *testing.T) {
+	date := func(y int, m time.Month) time.Time { return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC) }
+	months, promo := 3, model.Money(100)
+	trialEnd := date(2025, 6)
+	// trial in June, then 3 months for 1 ruble
+	sub := &model.Subscription{
+		Price:     29900,
+		StartDate: date(2025, 6),
+		TrialEnd:  &trialEnd,
+		Discount:  &model.Discount{Price: &promo, Months: &months},
+	}
+	totals := make([]model.Money, 5) // Jun-Oct 2025
+
+	if err := spreadMonthly(totals, date(2025, 6), sub, nil, nil, nil); err != nil {
+		t.Fatalf("spreadMonthly failed: %v", err)
+	}
+
+	want := []model.Money{0, 100, 100, 100, 29900}
+	for i := range want {
+		if totals[i] != want[i] {
+			t.Fatalf("totals = %v; want %v", totals, want)
+		}
+	}
+}
+
+func TestNextRenewal(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	end := date(2025, 8, 1)
+	cases := []struct {
+		name       string
+		start      time.Time
+		end        *time.Time
+		billingDay int
+		from       time.Time
+		want       time.Time
+		ok         bool
+	}{
+		{"later this month", date(2025, 1, 1), nil, 20, date(2025, 7, 10), date(2025, 7, 20), true},
+		{"on the billing day", date(2025, 1, 1), nil, 10, date(2025, 7, 10), date(2025, 7, 10), true},
+		{"next month", date(2025, 1, 1), nil, 5, date(2025, 7, 10), date(2025, 8, 5), true},
+		{"clamped to short month", date(2025, 1, 1), nil, 31, date(2025, 2, 1), date(2025, 2, 28), true},
+		{"starts in the future", date(2025, 9, 1), nil, 15, date(2025, 7, 10), date(2025, 9, 15), true},
+		{"last charge in end month", date(2025, 1, 1), &end, 15, date(2025, 8, 1), date(2025, 8, 15), true},
+		{"already ended", date(2025, 1, 1), &end, 5, date(2025, 8, 10), time.Time{}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := nextRenewal(c.start, c.end, c.billingDay, c.from)
+			if ok != c.ok || !got.Equal(c.want) {
+				t.Fatalf("nextRenewal() = %v, %v; want %v, %v", got, ok, c.want, c.ok)
+			}
+		})
+	}
+}
+
+func TestPausedIn(t *testing.T) {
+	date := func(y int, m time.Month) time.Time { return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC) }
+	aug := date(2025, 8)
+	pauses := []model.Pause{
+		{StartDate: date(2025, 5), EndDate: &aug}, // May-Aug
+		{StartDate: date(2025, 11)},               // open-ended from November
+	}
+	cases := []struct {
+		month time.Time
+		want  bool
+	}{
+		{date(2025, 4), false},
+		{date(2025, 5), true},
+		{time.Date(2025, 8, 20, 0, 0, 0, 0, time.UTC), true},
+		{date(2025, 9), false},
+		{date(2026, 3), true},
+	}
+	for _, c := range cases {
+		if got := pausedIn(pauses, c.month); got != c.want {
+			t.Fatalf("pausedIn(%v) = %v; want %v", c.month, got, c.want)
+		}
+	}
+}
+
+func TestConverter(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	c := &converter{target: "RUB", rates: map[string][]model.ExchangeRate{
+		"USD": {{Date: date(2025, 6, 30), Rate: "1.25"}, {Date: date(2025, 7, 31), Rate: "1.1"}},
+		"RUB": {{Date: date(2025, 6, 30), Rate: "100"}, {Date: date(2025, 7, 31), Rate: "88"}},
+	}}
+	cases := []struct {
+		amount   model.Money
+		currency string
+		month    time.Time
+		want     model.Money
+	}{
+		{999, "USD", date(2025, 6, 1), 79920},  // 9.99 USD * 100 / 1.25
+		{999, "USD", date(2025, 7, 1), 79920},  // 9.99 USD * 88 / 1.1
+		{1000, "EUR", date(2025, 7, 1), 88000}, // 10 EUR * 88
+		{1, "USD", date(2025, 6, 1), 80},       // 0.01 USD -> 0.80 RUB
+		{500, "RUB", date(2020, 1, 1), 500},    // no conversion needed
+	}
+	for _, cs := range cases {
+		got, err := c.convert(cs.amount, cs.currency, cs.month)
+		if err != nil || got != cs.want {
+			t.Fatalf("convert(%v %s, %v) = %v, %v; want %v", cs.amount, cs.currency, cs.month, got, err, cs.want)
+		}
+	}
+	if _, err := c.convert(100, "USD", date(2025, 5, 1)); !errors.Is(err, ErrNoRate) {
+		t.Fatalf("expected ErrNoRate before the first rate, got %v", err)
+	}
+}
+
+func TestSplitCharge(t *testing.T) {
+	owner, a, b := uuid.New(), uuid.New(), uuid.New()
+	pct := func(v int) *int { return &v }
+	amt := func(v model.Money) *model.Money { return &v }
+	cases := []struct {
+		name    string
+		split   string
+		members []model.Member
+		want    map[uuid.UUID]model.Money
+	}{
+		{"no members", model.SplitEqual, nil, map[uuid.UUID]model.Money{owner: 1000}},
+		{"equal", model.SplitEqual, []model.Member{{UserID: a}, {UserID: b}},
+			map[uuid.UUID]model.Money{owner: 334, a: 333, b: 333}},
+		{"percent", model.SplitPercent, []model.Member{{UserID: a, Percent: pct(25)}, {UserID: b, Percent: pct(50)}},
+			map[uuid.UUID]model.Money{owner: 250, a: 250, b: 500}},
+		{"fixed above price", model.SplitFixed, []model.Member{{UserID: a, Amount: amt(700)}, {UserID: b, Amount: amt(700)}},
+			map[uuid.UUID]model.Money{owner: 0, a: 700, b: 300}},
+	}
+	for _, c := range cases {
+		sub := &model.Subscription{UserID: owner, Split: c.split}
+		got := splitCharge(1000, sub, c.members)
+		if len(got) != len(c.want) {
+			t.Fatalf("%s: splitCharge = %v; want %v", c.name, got, c.want)
+		}
+		for u, v := range c.want {
+			if got[u] != v {
+				t.Fatalf("%s: splitCharge = %v; want %v", c.name, got, c.want)
+			}
+		}
+	}
+}
+
+func TestSpreadShares_Currency(t *testing.T) {
+	owner, a := uuid.New(), uuid.New()
+	from := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+	conv := &converter{target: "RUB", rates: map[string][]model.ExchangeRate{
+		"USD": {{Date: time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC), Rate: "1.25"}},
+		"RUB": {{Date: time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC), Rate: "100"}},
+	}}
+	// 10 USD a month, of which the member pays a fixed 4 USD
+	fixed := model.Money(400)
+	sub := &model.Subscription{UserID: owner, Price: 1000, Currency: "USD", Split: model.SplitFixed,
+		StartDate: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	members := []model.Member{{UserID: a, Amount: &fixed}}
+
+	got := map[uuid.UUID][]model.Money{owner: make([]model.Money, 2), a: make([]model.Money, 2)}
+	err := spreadShares(2, from, sub, nil, nil, members, conv, func(m int, user uuid.UUID, share model.Money) {
+		got[user][m] += share
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4 USD and 6 USD at 80 RUB per USD
+	for m := 0; m < 2; m++ {
+		if got[a][m] != 32000 || got[owner][m] != 48000 {
+			t.Fatalf("shares = %v; want 32000 RUB for the member and 48000 RUB for the owner", got)
+		}
+	}
+}
+
+func TestSettle(t *testing.T) {
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+	debts := map[[2]uuid.UUID]model.Money{
+		{a, b}: 1000,
+		{b, a}: 400,
+		{c, a}: 500,
+		{b, c}: 300,
+		{c, b}: 300,
+	}
+	got := settle(debts, nil, "RUB")
+	want := map[[2]uuid.UUID]model.Money{{a, b}: 600, {c, a}: 500}
+	if len(got) != len(want) {
+		t.Fatalf("settle = %+v; want %v", got, want)
+	}
+	for _, d := range got {
+		if want[[2]uuid.UUID{d.From, d.To}] != d.Amount || d.Currency != "RUB" {
+			t.Fatalf("settle = %+v; want %v", got, want)
+		}
+	}
+	if got := settle(debts, &c, "RUB"); len(got) != 1 || got[0].From != c {
+		t.Fatalf("settle for user = %+v", got)
+	}
+}
+
+func TestFilterWhere(t *testing.T) {
+	uid := uuid.New()
+	name := "Yandex_Plus"
+	tag := "music"
+	cur := "USD"
+	lo, hi := model.Money(30000), model.Money(50000)
+	from, to := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 9, 30, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name  string
+		f     Filter
+		where string
+		args  []interface{}
+	}{
+		{"empty", Filter{}, "", nil},
+		// the placeholder follows the arguments, whichever filters are set
+		{"service only", spendFilter(Filter{ServiceName: &name}, from, to),
+			" WHERE (end_date IS NULL OR end_date >= $1) AND start_date <= $2 AND service_id IN (SELECT service_id FROM service_aliases WHERE alias = $3)",
+			[]interface{}{from, to, "yandex_plus"}},
+		{"prefix case-sensitive", Filter{UserID: &uid, ServiceName: &name, Match: MatchPrefix, CaseSensitive: true},
+			" WHERE (user_id = $1 OR id IN (SELECT subscription_id FROM subscription_members WHERE user_id = $1)) AND service_name LIKE $2",
+			[]interface{}{uid, `Yandex\_Plus%`}},
+		{"contains and tag", Filter{ServiceName: &name, Match: MatchContains, Tags: []string{tag}},
+			" WHERE service_id IN (SELECT service_id FROM service_aliases WHERE alias LIKE $1) AND id IN (SELECT st.subscription_id FROM subscription_tags st JOIN tags t ON t.id = st.tag_id WHERE t.name = $2)",
+			[]interface{}{`%yandex\_plus%`, "music"}},
+		{"negations and price", Filter{ExcludeServices: []string{"Okko"}, ExcludeTags: []string{"work"}, Currency: &cur, PriceMin: &lo, PriceMax: &hi},
+			" WHERE service_id NOT IN (SELECT service_id FROM service_aliases WHERE alias = $1) AND id NOT IN (SELECT st.subscription_id FROM subscription_tags st JOIN tags t ON t.id = st.tag_id WHERE t.name = $2) AND currency = $3 AND price >= $4 AND price <= $5",
+			[]interface{}{"okko", "work", "USD", lo, hi}},
+	}
+	for _, c := range cases {
+		where, args := c.f.where(nil)
+		if where != c.where {
+			t.Fatalf("%s: where = %q; want %q", c.name, where, c.where)
+		}
+		if len(args) != len(c.args) {
+			t.Fatalf("%s: args = %v; want %v", c.name, args, c.args)
+		}
+		for i := range args {
+			if args[i] != c.args[i] {
+				t.Fatalf("%s: args = %v; want %v", c.name, args, c.args)
+			}
+		}
+	}
+	fuzzy := Filter{ServiceName: &name, Match: MatchFuzzy}
+	where, args := fuzzy.where(nil)
+	order, args := fuzzy.orderBy(args)
+	if where != " WHERE service_id IN (SELECT service_id FROM service_aliases WHERE alias % $1)" ||
+		!strings.HasPrefix(order, " ORDER BY (SELECT max(similarity(a.alias, $2))") || len(args) != 2 {
+		t.Fatalf("unexpected fuzzy query: %q %q %v", where, order, args)
+	}
+	if (&PostgresRepo{}).filter(fuzzy).Match != MatchContains {
+		t.Fatalf("expected fuzzy matching to fall back to contains without pg_trgm")
+	}
+	if _, err := ParseMatchMode("soundex"); err == nil {
+		t.Fatalf("expected an unknown match mode to be rejected")
+	}
+}
+
+func TestSanitizeSQL(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"SELECT id\n\t FROM subscriptions\n WHERE user_id = $1 AND price > 100", "SELECT id FROM subscriptions WHERE user_id = $1 AND price > ?"},
+		{`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm')`, "SELECT EXISTS (SELECT ? FROM pg_extension WHERE extname = ?)"},
+		{`UPDATE t SET name = 'it''s', v2 = -1.5 WHERE id = $12`, "UPDATE t SET name = ?, v2 = ? WHERE id = $12"},
+	}
+	for _, c := range cases {
+		if got := sanitizeSQL(c.in); got != c.want {
+			t.Errorf("sanitizeSQL(%q) = %q; want %q", c.in, got, c.want)
+		}
+	}
+}
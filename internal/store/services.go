@@ -0,0 +1,209 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// ErrServiceExists is returned when a new service's name is already in the catalog
+var ErrServiceExists = errors.New("service already exists")
+
+const serviceColumns = `s.id, s.name, s.default_price, s.currency`
+
+// serviceKeySQL is model.ServiceKey of a column in SQL, used by the backfill
+func serviceKeySQL(col string) string {
+	return `lower(regexp_replace(btrim(` + col + `), '\s+', ' ', 'g'))`
+}
+
+// FindService returns the catalog service name is an alias of, nil if there is none
+func (p *PostgresRepo) FindService(name string) (*model.Service, error) {
+	var svc model.Service
+	q := `SELECT ` + serviceColumns + ` FROM services s JOIN service_aliases a ON a.service_id = s.id WHERE a.alias=$1`
+	if err := p.db.Get(&svc, q, model.ServiceKey(name)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	aliases, err := aliasesFor(p.db, []model.Service{svc})
+	if err != nil {
+		return nil, err
+	}
+	svc.Aliases = aliases[svc.ID]
+	return &svc, nil
+}
+
+// SearchServices autocompletes service names: services with an alias starting
+// with query, or with a word of it starting with query
+func (p *PostgresRepo) SearchServices(query string, limit int) ([]model.Service, error) {
+	key := likeEscaper.Replace(model.ServiceKey(query))
+	q := `SELECT ` + serviceColumns + ` FROM services s
+	WHERE s.id IN (SELECT service_id FROM service_aliases WHERE alias LIKE $1 OR alias LIKE $2)
+	ORDER BY s.name LIMIT $3`
+	res := []model.Service{}
+	if err := p.db.Select(&res, q, key+"%", "% "+key+"%", limit); err != nil {
+		return nil, err
+	}
+	aliases, err := aliasesFor(p.db, res)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		res[i].Aliases = aliases[res[i].ID]
+	}
+	return res, nil
+}
+
+// CreateService adds a service to the catalog with its aliases
+func (p *PostgresRepo) CreateService(svc *model.Service) error {
+	if svc.ID == uuid.Nil {
+		svc.ID = uuid.New()
+	}
+	if svc.Currency == "" {
+		svc.Currency = model.BaseCurrency
+	}
+	svc.Name = strings.Join(strings.Fields(svc.Name), " ")
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.Get(&n, `SELECT count(*) FROM service_aliases WHERE alias=$1`, model.ServiceKey(svc.Name)); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrServiceExists
+	}
+	q := `INSERT INTO services (id, name, default_price, currency) VALUES ($1,$2,$3,$4)`
+	if _, err := tx.Exec(q, svc.ID, svc.Name, svc.DefaultPrice, svc.Currency); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrServiceExists
+		}
+		return err
+	}
+	if err := addAliases(tx, svc, append([]string{svc.Name}, svc.Aliases...)); err != nil {
+		return err
+	}
+	aliases, err := aliasesFor(tx, []model.Service{*svc})
+	if err != nil {
+		return err
+	}
+	svc.Aliases = aliases[svc.ID]
+	return tx.Commit()
+}
+
+// AddAliases adds aliases to a service; an alias naming another service merges
+// that service into this one. sql.ErrNoRows is returned for an unknown service
+func (p *PostgresRepo) AddAliases(serviceID uuid.UUID, aliases []string) (*model.Service, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var svc model.Service
+	if err := tx.Get(&svc, `SELECT `+serviceColumns+` FROM services s WHERE s.id=$1 FOR UPDATE`, serviceID); err != nil {
+		return nil, err
+	}
+	if err := addAliases(tx, &svc, aliases); err != nil {
+		return nil, err
+	}
+	all, err := aliasesFor(tx, []model.Service{svc})
+	if err != nil {
+		return nil, err
+	}
+	svc.Aliases = all[svc.ID]
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &svc, nil
+}
+
+func addAliases(tx *tracedTx, svc *model.Service, aliases []string) error {
+	for _, a := range aliases {
+		key := model.ServiceKey(a)
+		var owner uuid.UUID
+		err := tx.Get(&owner, `SELECT service_id FROM service_aliases WHERE alias=$1`, key)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if _, err := tx.Exec(`INSERT INTO service_aliases (alias, service_id) VALUES ($1,$2)`, key, svc.ID); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case owner != svc.ID:
+			// the same service under another name, e.g. one created from a subscription
+			if _, err := tx.Exec(`UPDATE subscriptions SET service_id=$1 WHERE service_id=$2`, svc.ID, owner); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE service_aliases SET service_id=$1 WHERE service_id=$2`, svc.ID, owner); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM services WHERE id=$1`, owner); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveService points sub at the catalog service its name is an alias of,
+// adding the name to the catalog if it is new; the name as entered is kept
+func resolveService(tx *tracedTx, sub *model.Subscription) error {
+	key := model.ServiceKey(sub.ServiceName)
+	q := `SELECT ` + serviceColumns + ` FROM services s JOIN service_aliases a ON a.service_id = s.id WHERE a.alias=$1`
+	var svc model.Service
+	err := tx.Get(&svc, q, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		// concurrent creates of the same name end up with the same service
+		id := uuid.New()
+		name := strings.Join(strings.Fields(sub.ServiceName), " ")
+		if _, err := tx.Exec(`INSERT INTO services (id, name) VALUES ($1,$2) ON CONFLICT (name) DO NOTHING`, id, name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO service_aliases (alias, service_id) SELECT $1, id FROM services WHERE name=$2 ON CONFLICT DO NOTHING`, key, name); err != nil {
+			return err
+		}
+		err = tx.Get(&svc, q, key)
+	}
+	if err != nil {
+		return err
+	}
+	sub.ServiceID = &svc.ID
+	sub.CanonicalName = svc.Name
+	return nil
+}
+
+// likeEscaper escapes LIKE wildcards in user input
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// aliasesFor loads the sorted aliases of services keyed by service id
+func aliasesFor(q sqlx.Queryer, services []model.Service) (map[uuid.UUID][]string, error) {
+	res := map[uuid.UUID][]string{}
+	if len(services) == 0 {
+		return res, nil
+	}
+	ids := make([]string, 0, len(services))
+	for _, s := range services {
+		ids = append(ids, s.ID.String())
+	}
+	var rows []struct {
+		ServiceID uuid.UUID `db:"service_id"`
+		Alias     string    `db:"alias"`
+	}
+	err := sqlx.Select(q, &rows, `SELECT service_id, alias FROM service_aliases WHERE service_id = ANY($1::uuid[]) ORDER BY alias`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		res[r.ServiceID] = append(res[r.ServiceID], r.Alias)
+	}
+	return res, nil
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// SetMembers replaces the members of a shared subscription and its split rule
+func (p *PostgresRepo) SetMembers(subscriptionID uuid.UUID, split string, members []model.Member) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE subscriptions SET split=$1 WHERE id=$2`, split, subscriptionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM subscription_members WHERE subscription_id=$1`, subscriptionID); err != nil {
+		return err
+	}
+	q := `INSERT INTO subscription_members (subscription_id, user_id, percent, amount) VALUES ($1,$2,$3,$4)`
+	for _, m := range members {
+		if _, err := tx.Exec(q, subscriptionID, m.UserID, m.Percent, m.Amount); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresRepo) ListMembers(subscriptionID uuid.UUID) ([]model.Member, error) {
+	q := `SELECT subscription_id, user_id, percent, amount FROM subscription_members WHERE subscription_id=$1 ORDER BY user_id`
+	members := []model.Member{}
+	if err := p.db.Select(&members, q, subscriptionID); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// Settlement returns what members of shared subscriptions owe their owners for
+// [from,to], netted per pair of users; with userID set only debts involving that
+// user are returned
+func (p *PostgresRepo) Settlement(userID *uuid.UUID, from, to time.Time, currency string) ([]model.Debt, error) {
+	q := `SELECT ` + spendColumns + ` FROM subscriptions WHERE (end_date IS NULL OR end_date >= $1) AND start_date <= $2
+	AND id IN (SELECT subscription_id FROM subscription_members)`
+	args := []interface{}{from, to}
+	if userID != nil {
+		args = append(args, *userID)
+		q += ` AND (user_id = $3 OR id IN (SELECT subscription_id FROM subscription_members WHERE user_id = $3))`
+	}
+	var subs []model.Subscription
+	if err := p.db.Select(&subs, q, args...); err != nil {
+		return nil, err
+	}
+	from = firstOfMonth(from)
+	months := monthsInclusive(from, to)
+	pauses, err := pausesFor(p.db, subs)
+	if err != nil {
+		return nil, err
+	}
+	prices, err := pricesFor(p.db, subs)
+	if err != nil {
+		return nil, err
+	}
+	members, err := membersFor(p.db, subs)
+	if err != nil {
+		return nil, err
+	}
+	conv, err := loadConverter(p.db, currency, subs, from, to)
+	if err != nil {
+		return nil, err
+	}
+	debts := map[[2]uuid.UUID]model.Money{}
+	for i := range subs {
+		sub := &subs[i]
+		err := spreadShares(months, from, sub, pauses[sub.ID], prices[sub.ID], members[sub.ID], conv, func(_ int, user uuid.UUID, share model.Money) {
+			if user != sub.UserID {
+				debts[[2]uuid.UUID{user, sub.UserID}] += share
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return settle(debts, userID, currency), nil
+}
+
+// settle nets debts between each pair of users, keyed by [debtor, creditor]
+func settle(debts map[[2]uuid.UUID]model.Money, userID *uuid.UUID, currency string) []model.Debt {
+	res := []model.Debt{}
+	for k, amount := range debts {
+		debtor, creditor := k[0], k[1]
+		back := debts[[2]uuid.UUID{creditor, debtor}]
+		// each pair is handled once, from the side that owes more
+		if amount < back || (amount == back && bytes.Compare(debtor[:], creditor[:]) > 0) {
+			continue
+		}
+		if net := amount - back; net > 0 {
+			if userID != nil && *userID != debtor && *userID != creditor {
+				continue
+			}
+			res = append(res, model.Debt{From: debtor, To: creditor, Amount: net, Currency: currency})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if c := bytes.Compare(res[i].From[:], res[j].From[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(res[i].To[:], res[j].To[:]) < 0
+	})
+	return res
+}
+
+// spreadShares spreads sub over the months starting at from like spreadMonthly
+// and calls add with the share of every user in each of them, converted by conv;
+// fixed shares are in the currency of sub, so the charge is split before it is
+// converted
+func spreadShares(months int, from time.Time, sub *model.Subscription, pauses []model.Pause, prices []model.PricePoint, members []model.Member, conv *converter, add func(month int, user uuid.UUID, share model.Money)) error {
+	charges := make([]model.Money, months)
+	if err := spreadMonthly(charges, from, sub, pauses, prices, nil); err != nil {
+		return err
+	}
+	for m, c := range charges {
+		if c == 0 {
+			continue
+		}
+		for user, share := range splitCharge(c, sub, members) {
+			amount, err := conv.convert(share, currencyOf(sub), from.AddDate(0, m, 0))
+			if err != nil {
+				return err
+			}
+			add(m, user, amount)
+		}
+	}
+	return nil
+}
+
+// splitCharge splits a monthly charge between the owner of sub and its members:
+// equally, by percent or by fixed amounts, the owner paying what is left
+func splitCharge(charge model.Money, sub *model.Subscription, members []model.Member) map[uuid.UUID]model.Money {
+	shares := map[uuid.UUID]model.Money{}
+	var others []model.Member
+	for _, m := range members {
+		if m.UserID != sub.UserID {
+			others = append(others, m)
+		}
+	}
+	left := charge
+	switch sub.Split {
+	case model.SplitPercent:
+		for _, m := range others {
+			if m.Percent == nil {
+				continue
+			}
+			share := (charge*model.Money(*m.Percent) + 50) / 100
+			if share > left {
+				share = left
+			}
+			shares[m.UserID] = share
+			left -= share
+		}
+	case model.SplitFixed:
+		for _, m := range others {
+			if m.Amount == nil {
+				continue
+			}
+			share := *m.Amount
+			if share > left {
+				share = left
+			}
+			shares[m.UserID] = share
+			left -= share
+		}
+	default:
+		// equal parts, the owner also pays the indivisible remainder
+		part := charge / model.Money(len(others)+1)
+		for _, m := range others {
+			shares[m.UserID] = part
+			left -= part
+		}
+	}
+	shares[sub.UserID] += left
+	return shares
+}
+
+// membersFor loads the members of subs keyed by subscription id
+func membersFor(q sqlx.Queryer, subs []model.Subscription) (map[uuid.UUID][]model.Member, error) {
+	res := map[uuid.UUID][]model.Member{}
+	if len(subs) == 0 {
+		return res, nil
+	}
+	ids := make([]string, 0, len(subs))
+	for _, s := range subs {
+		ids = append(ids, s.ID.String())
+	}
+	var members []model.Member
+	err := sqlx.Select(q, &members, `SELECT subscription_id, user_id, percent, amount FROM subscription_members WHERE subscription_id = ANY($1::uuid[]) ORDER BY user_id`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range members {
+		res[m.SubscriptionID] = append(res[m.SubscriptionID], m)
+	}
+	return res, nil
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"sort"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/model"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// AggregateByTag sums the spend of the subscriptions f selects over [from,to] per tag;
+// a subscription with several tags counts towards each of them and untagged
+// subscriptions are summed under a nil category
+func (p *PostgresRepo) AggregateByTag(f Filter, from, to time.Time, currency string) ([]model.CategoryTotal, error) {
+	f = p.filter(f)
+	where, args := spendFilter(f, from, to).where(nil)
+	q := `SELECT ` + spendColumns + ` FROM subscriptions` + where
+	tx, err := p.begin(f)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var subs []model.Subscription
+	if err := tx.Select(&subs, q, args...); err != nil {
+		return nil, err
+	}
+	tags, err := tagsFor(tx, subs)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string][]model.Subscription{}
+	var untagged []model.Subscription
+	for _, s := range subs {
+		if len(tags[s.ID]) == 0 {
+			untagged = append(untagged, s)
+		}
+		for _, t := range tags[s.ID] {
+			groups[t] = append(groups[t], s)
+		}
+	}
+	from = firstOfMonth(from)
+	months := monthsInclusive(from, to)
+	res := []model.CategoryTotal{}
+	add := func(category *string, subs []model.Subscription) error {
+		totals, err := spend(tx, subs, from, months, currency, f.UserID)
+		if err != nil {
+			return err
+		}
+		ct := model.CategoryTotal{Category: category}
+		for _, t := range totals {
+			ct.Total += t
+		}
+		res = append(res, ct)
+		return nil
+	}
+	for tag, subs := range groups {
+		tag := tag
+		if err := add(&tag, subs); err != nil {
+			return nil, err
+		}
+	}
+	if len(untagged) > 0 {
+		if err := add(nil, untagged); err != nil {
+			return nil, err
+		}
+	}
+	// largest first, untagged after the tags with the same total
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		if a.Category == nil || b.Category == nil {
+			return b.Category == nil && a.Category != nil
+		}
+		return *a.Category < *b.Category
+	})
+	return res, nil
+}
+
+// setTags replaces the tags of a subscription, creating missing ones
+func setTags(e sqlx.Execer, subscriptionID uuid.UUID, tags []string) error {
+	if _, err := e.Exec(`DELETE FROM subscription_tags WHERE subscription_id=$1`, subscriptionID); err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if _, err := e.Exec(`INSERT INTO tags (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, t); err != nil {
+			return err
+		}
+		q := `INSERT INTO subscription_tags (subscription_id, tag_id) SELECT $1, id FROM tags WHERE name=$2 ON CONFLICT DO NOTHING`
+		if _, err := e.Exec(q, subscriptionID, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagsFor loads the sorted tag names of subs keyed by subscription id
+func tagsFor(q sqlx.Queryer, subs []model.Subscription) (map[uuid.UUID][]string, error) {
+	res := map[uuid.UUID][]string{}
+	if len(subs) == 0 {
+		return res, nil
+	}
+	ids := make([]string, 0, len(subs))
+	for _, s := range subs {
+		ids = append(ids, s.ID.String())
+	}
+	var rows []struct {
+		SubscriptionID uuid.UUID `db:"subscription_id"`
+		Name           string    `db:"name"`
+	}
+	err := sqlx.Select(q, &rows, `SELECT st.subscription_id, t.name FROM subscription_tags st JOIN tags t ON t.id = st.tag_id
+	WHERE st.subscription_id = ANY($1::uuid[]) ORDER BY t.name`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		res[r.SubscriptionID] = append(res[r.SubscriptionID], r.Name)
+	}
+	return res, nil
+}
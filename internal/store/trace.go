@@ -0,0 +1,185 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/effectivemobile/subscriptions/internal/tracing"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// bound is what the queries of a repository run under: the context of the
+// request, which cancels and traces them, and its log
+type bound struct {
+	ctx context.Context
+	log *logrus.Entry
+}
+
+// start begins a child span of the request for query, the returned func ends
+// it and logs the query at debug level
+func (b bound) start(query string) func(err error) {
+	span := startQuery(b.ctx, query)
+	begin := time.Now()
+	return func(err error) {
+		tracing.End(span, err)
+		if b.log != nil && b.log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+			b.log.WithFields(logrus.Fields{
+				"query":  sanitizeSQL(query),
+				"dur_ms": time.Since(begin).Milliseconds(),
+			}).Debug("ran query")
+		}
+	}
+}
+
+// tracedDB runs the queries of a repository bound to a request; it satisfies
+// sqlx.Queryer and sqlx.Execer, so the query helpers are traced as well
+type tracedDB struct {
+	*sqlx.DB
+	bound
+}
+
+func (d *tracedDB) Beginx() (*tracedTx, error) {
+	tx, err := d.DB.BeginTxx(d.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedTx{Tx: tx, bound: d.bound}, nil
+}
+
+func (d *tracedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	done := d.start(query)
+	res, err := d.DB.ExecContext(d.ctx, query, args...)
+	done(err)
+	return res, err
+}
+
+func (d *tracedDB) Get(dest interface{}, query string, args ...interface{}) error {
+	done := d.start(query)
+	err := d.DB.GetContext(d.ctx, dest, query, args...)
+	done(ignoreNoRows(err))
+	return err
+}
+
+func (d *tracedDB) Select(dest interface{}, query string, args ...interface{}) error {
+	done := d.start(query)
+	err := d.DB.SelectContext(d.ctx, dest, query, args...)
+	done(err)
+	return err
+}
+
+func (d *tracedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	done := d.start(query)
+	rows, err := d.DB.QueryContext(d.ctx, query, args...)
+	done(err)
+	return rows, err
+}
+
+func (d *tracedDB) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	done := d.start(query)
+	rows, err := d.DB.QueryxContext(d.ctx, query, args...)
+	done(err)
+	return rows, err
+}
+
+func (d *tracedDB) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	done := d.start(query)
+	row := d.DB.QueryRowxContext(d.ctx, query, args...)
+	done(ignoreNoRows(row.Err()))
+	return row
+}
+
+// tracedTx is the transaction counterpart of tracedDB
+type tracedTx struct {
+	*sqlx.Tx
+	bound
+}
+
+func (t *tracedTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	done := t.start(query)
+	res, err := t.Tx.ExecContext(t.ctx, query, args...)
+	done(err)
+	return res, err
+}
+
+func (t *tracedTx) Get(dest interface{}, query string, args ...interface{}) error {
+	done := t.start(query)
+	err := t.Tx.GetContext(t.ctx, dest, query, args...)
+	done(ignoreNoRows(err))
+	return err
+}
+
+func (t *tracedTx) Select(dest interface{}, query string, args ...interface{}) error {
+	done := t.start(query)
+	err := t.Tx.SelectContext(t.ctx, dest, query, args...)
+	done(err)
+	return err
+}
+
+func (t *tracedTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	done := t.start(query)
+	rows, err := t.Tx.QueryContext(t.ctx, query, args...)
+	done(err)
+	return rows, err
+}
+
+func (t *tracedTx) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	done := t.start(query)
+	rows, err := t.Tx.QueryxContext(t.ctx, query, args...)
+	done(err)
+	return rows, err
+}
+
+func (t *tracedTx) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	done := t.start(query)
+	row := t.Tx.QueryRowxContext(t.ctx, query, args...)
+	done(ignoreNoRows(row.Err()))
+	return row
+}
+
+// startQuery begins a span named after the statement, one that does nothing
+// when ctx is not traced
+func startQuery(ctx context.Context, query string) trace.Span {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return trace.SpanFromContext(ctx)
+	}
+	stmt := sanitizeSQL(query)
+	op := stmt
+	if i := strings.IndexByte(op, ' '); i > 0 {
+		op = op[:i]
+	}
+	_, span := tracing.Start(ctx, "postgres "+strings.ToUpper(op), trace.SpanKindClient,
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.statement", stmt),
+	)
+	return span
+}
+
+// not finding a row is an answer, not a failed query
+func ignoreNoRows(err error) error {
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+var (
+	sqlStrings = regexp.MustCompile(`'(?:[^']|'')*'`)
+	// numbers that are not part of a placeholder or an identifier
+	sqlNumbers = regexp.MustCompile(`(^|[^\w$.])-?\d+(?:\.\d+)?`)
+	sqlSpaces  = regexp.MustCompile(`\s+`)
+)
+
+// sanitizeSQL replaces the literals of a statement with ? and collapses its
+// whitespace, so that spans never carry user data and group by statement;
+// the values of placeholders are never recorded
+func sanitizeSQL(query string) string {
+	query = sqlStrings.ReplaceAllString(query, "?")
+	query = sqlNumbers.ReplaceAllString(query, "${1}?")
+	return strings.TrimSpace(sqlSpaces.ReplaceAllString(query, " "))
+}
@@ -0,0 +1,159 @@
+// Package tlsconfig builds the TLS configuration of the server from PEM files
+// and reloads them when they change on disk, so that renewed certificates are
+// served without a restart.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the files are looked at no more often than this, on the next handshake
+const checkInterval = 10 * time.Second
+
+// protocols offered over ALPN; the config returned for a client replaces the
+// server's, so without them HTTP/2 would not be negotiated
+var nextProtos = []string{"h2", "http/1.1"}
+
+type Options struct {
+	CertFile string
+	KeyFile  string
+	// PEM bundle of the CAs that sign client certificates, enables mutual TLS
+	ClientCAFile string
+	// accept clients without a certificate, those presenting one are still verified
+	ClientCertOptional bool
+}
+
+// Reloader holds the certificates loaded from the files of Options
+type Reloader struct {
+	o   Options
+	log logrus.FieldLogger
+	now func() time.Time
+
+	mu      sync.Mutex
+	config  *tls.Config
+	loaded  []time.Time
+	checked time.Time
+}
+
+// New loads the files of o, failing when they are missing or invalid
+func New(o Options, log logrus.FieldLogger) (*Reloader, error) {
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, errors.New("both a certificate and a key file are required")
+	}
+	r := &Reloader{o: o, log: log, now: time.Now}
+	mod, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(mod); err != nil {
+		return nil, err
+	}
+	r.checked = r.now()
+	return r, nil
+}
+
+// TLSConfig returns the configuration to serve with, every handshake gets the
+// certificates last loaded
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &r.current().Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+// current reloads the files if they changed since they were loaded; a failed
+// reload keeps the previous certificates and is retried on the next check
+func (r *Reloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if now.Sub(r.checked) < checkInterval {
+		return r.config
+	}
+	r.checked = now
+	mod, err := r.modTimes()
+	if err == nil && !changed(mod, r.loaded) {
+		return r.config
+	}
+	if err == nil {
+		err = r.load(mod)
+	}
+	if err != nil {
+		if r.log != nil {
+			r.log.Warnf("failed to reload TLS certificates, serving the previous ones: %v", err)
+		}
+		return r.config
+	}
+	if r.log != nil {
+		r.log.Info("reloaded TLS certificates")
+	}
+	return r.config
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.o.CertFile, r.o.KeyFile}
+	if r.o.ClientCAFile != "" {
+		files = append(files, r.o.ClientCAFile)
+	}
+	return files
+}
+
+func (r *Reloader) modTimes() ([]time.Time, error) {
+	var mod []time.Time
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		mod = append(mod, fi.ModTime())
+	}
+	return mod, nil
+}
+
+func changed(a, b []time.Time) bool {
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reloader) load(mod []time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.o.CertFile, r.o.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: nextProtos, Certificates: []tls.Certificate{cert}}
+	if r.o.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.o.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", r.o.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if r.o.ClientCertOptional {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	r.config, r.loaded = config, mod
+	return nil
+}
@@ -0,0 +1,148 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for localhost with serial and its key
+func writeCert(t *testing.T, certFile, keyFile string, serial int64, mod time.Time) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// served returns the serial of the certificate the server presents
+func served(t *testing.T, config *tls.Config, roots *x509.CertPool) int64 {
+	return handshake(t, config, roots).PeerCertificates[0].SerialNumber.Int64()
+}
+
+// handshake connects to a server with config as a client offering HTTP/2
+func handshake(t *testing.T, config *tls.Config, roots *x509.CertPool) tls.ConnectionState {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		tls.Server(server, config).Handshake()
+	}()
+	conn := tls.Client(client, &tls.Config{RootCAs: roots, ServerName: "localhost", NextProtos: []string{"h2", "http/1.1"}})
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	return conn.ConnectionState()
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	start := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+	first := writeCert(t, certFile, keyFile, 1, start)
+
+	r, err := New(Options{CertFile: certFile, KeyFile: keyFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	config := r.TLSConfig()
+	roots := x509.NewCertPool()
+	roots.AddCert(first)
+	if got := served(t, config, roots); got != 1 {
+		t.Fatalf("expected certificate 1, got %d", got)
+	}
+	if p := handshake(t, config, roots).NegotiatedProtocol; p != "h2" {
+		t.Fatalf("expected HTTP/2 to be negotiated, got %q", p)
+	}
+
+	second := writeCert(t, certFile, keyFile, 2, start.Add(time.Hour))
+	roots.AddCert(second)
+	// the files are not looked at again before the interval is over
+	if got := served(t, config, roots); got != 1 {
+		t.Fatalf("expected certificate 1 until the next check, got %d", got)
+	}
+	now = now.Add(checkInterval)
+	if got := served(t, config, roots); got != 2 {
+		t.Fatalf("expected the renewed certificate, got %d", got)
+	}
+
+	// a broken file keeps the certificate served
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(checkInterval)
+	if got := served(t, config, roots); got != 2 {
+		t.Fatalf("expected the previous certificate after a failed reload, got %d", got)
+	}
+}
+
+func TestNew_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, 1, time.Now())
+
+	r, err := New(Options{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := r.current(); c.ClientAuth != tls.RequireAndVerifyClientCert || c.ClientCAs == nil {
+		t.Fatalf("expected client certificates to be required, got %v", c.ClientAuth)
+	}
+	r, err = New(Options{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile, ClientCertOptional: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := r.current(); c.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatalf("expected optional client certificates, got %v", c.ClientAuth)
+	}
+
+	if _, err := New(Options{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}, nil); err == nil {
+		t.Fatal("expected a CA file without certificates to fail")
+	}
+	if _, err := New(Options{CertFile: certFile}, nil); err == nil {
+		t.Fatal("expected a missing key file to fail")
+	}
+}
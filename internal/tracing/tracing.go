@@ -0,0 +1,165 @@
+// Package tracing records spans of HTTP requests and the work they cause with
+// the OpenTelemetry SDK and exports them to a collector over OTLP/HTTP.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation scope of the spans started here
+const scope = "github.com/effectivemobile/subscriptions"
+
+// Options of a Tracer; without an endpoint spans are not exported, but trace
+// ids are still handed out to correlate logs and error responses
+type Options struct {
+	// base URL of the collector, spans are posted to its /v1/traces
+	Endpoint    string
+	ServiceName string
+	// share of the traces started here that are exported, traces continued
+	// from a traceparent header follow the sampling decision of the caller
+	SampleRatio float64
+}
+
+// Tracer starts the root spans of requests
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// New returns a tracer, Shutdown flushes the spans it has not exported yet;
+// export failures are logged to log
+func New(o Options, log logrus.FieldLogger) (*Tracer, error) {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", o.ServiceName))),
+	}
+	if o.Endpoint != "" {
+		url := strings.TrimRight(o.Endpoint, "/")
+		if !strings.HasSuffix(url, "/v1/traces") {
+			url += "/v1/traces"
+		}
+		exp, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(url))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+	if log != nil {
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+			log.Warnf("tracing: %v", err)
+		}))
+	}
+	return newTracer(sdktrace.NewTracerProvider(opts...)), nil
+}
+
+func newTracer(p *sdktrace.TracerProvider) *Tracer {
+	return &Tracer{provider: p, tracer: p.Tracer(scope)}
+}
+
+// Shutdown exports the pending spans, giving up when ctx is done
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
+
+// TraceIDFromContext returns the hex id of the current trace, empty when there is none
+func TraceIDFromContext(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// Start begins a child of the current span; when ctx has no span the work is
+// not traced and the returned span does nothing
+func Start(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.SpanContext().IsValid() {
+		return ctx, parent
+	}
+	return parent.TracerProvider().Tracer(scope).Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// End finishes span, a non-nil err marks it failed
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// ErrorBody is the JSON body of an error response, it carries the trace id
+// when the request is traced so that clients can quote it in reports
+func ErrorBody(ctx context.Context, msg string) map[string]string {
+	body := map[string]string{"error": msg}
+	if id := TraceIDFromContext(ctx); id != "" {
+		body["trace_id"] = id
+	}
+	return body
+}
+
+// Middleware starts a server span per request, continuing the trace of a
+// W3C traceparent header; the span is named after the chi route pattern once
+// the router has matched the request
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	propagator := propagation.TraceContext{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := t.tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer))
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		route := "unmatched"
+		if rc := chi.RouteContext(ctx); rc != nil && rc.RoutePattern() != "" {
+			route = rc.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+			attribute.Int("http.response.status_code", status),
+		)
+		if id := middleware.GetReqID(ctx); id != "" {
+			span.SetAttributes(attribute.String("http.request_id", id))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+	})
+}
+
+// LogHook adds the trace and span ids to the log entries made with a traced context
+type LogHook struct{}
+
+func (LogHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (LogHook) Fire(e *logrus.Entry) error {
+	if e.Context == nil {
+		return nil
+	}
+	if sc := trace.SpanContextFromContext(e.Context); sc.IsValid() {
+		e.Data["trace_id"] = sc.TraceID().String()
+		e.Data["span_id"] = sc.SpanID().String()
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector stands in for an OpenTelemetry collector: it decodes the OTLP
+// export requests posted to it and keeps their spans
+type collector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	c.mu.Unlock()
+	resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(resp)
+}
+
+func newCollector(t *testing.T, o Options) (*collector, *Tracer) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+	o.Endpoint = srv.URL
+	tr, err := New(o, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, tr
+}
+
+func TestMiddleware_Export(t *testing.T) {
+	c, tr := newCollector(t, Options{ServiceName: "subscriptions", SampleRatio: 1})
+	var traceID string
+	r := chi.NewRouter()
+	r.Use(tr.Middleware)
+	r.Get("/subscriptions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		traceID = TraceIDFromContext(r.Context())
+		_, span := Start(r.Context(), "postgres SELECT", trace.SpanKindClient, attribute.String("db.statement", "SELECT 1"))
+		End(span, errors.New("no rows"))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/42", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("expected the trace of the traceparent header, got %q", traceID)
+	}
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.spans) != 2 {
+		t.Fatalf("expected 2 spans, got %+v", c.spans)
+	}
+	query, server := c.spans[0], c.spans[1]
+	if server.Name != "GET /subscriptions/{id}" || server.Kind != tracepb.Span_SPAN_KIND_SERVER || hex.EncodeToString(server.ParentSpanId) != "00f067aa0ba902b7" {
+		t.Fatalf("unexpected server span: %+v", server)
+	}
+	if string(query.ParentSpanId) != string(server.SpanId) || hex.EncodeToString(query.TraceId) != traceID || query.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR {
+		t.Fatalf("unexpected query span: %+v", query)
+	}
+}
+
+func TestMiddleware_Sampling(t *testing.T) {
+	c, tr := newCollector(t, Options{SampleRatio: 0})
+	var traceID string
+	h := tr.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceID = TraceIDFromContext(r.Context())
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	// a caller that did not sample is followed even though the header is valid
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	tr.Shutdown(context.Background())
+
+	if len(c.spans) != 0 {
+		t.Fatalf("expected unsampled traces not to be exported, got %+v", c.spans)
+	}
+	if traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("expected unsampled requests to have a trace id, got %q", traceID)
+	}
+}
+
+func TestMiddleware_InvalidTraceparent(t *testing.T) {
+	tr, err := New(Options{SampleRatio: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var traceID string
+	h := tr.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceID = TraceIDFromContext(r.Context())
+	}))
+	for _, header := range []string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("traceparent", header)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if traceID == "" || traceID == "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%q: expected a new trace, got %q", header, traceID)
+		}
+	}
+}
+
+func TestStart_Untraced(t *testing.T) {
+	ctx, span := Start(context.Background(), "query", trace.SpanKindClient)
+	if span.SpanContext().IsValid() || TraceIDFromContext(ctx) != "" {
+		t.Fatal("expected no span without a parent")
+	}
+	// the span does nothing
+	End(span, errors.New("no rows"))
+}
@@ -0,0 +1,48 @@
+// Package version holds build information injected at link time:
+//
+//	go build -ldflags "-X github.com/effectivemobile/subscriptions/internal/version.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/effectivemobile/subscriptions/internal/version.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// set with -ldflags -X, see the package comment
+var (
+	Commit    = ""
+	BuildTime = ""
+)
+
+// Build describes the running binary
+type Build struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	// time of the commit from the VCS stamp the go command embeds, not of the build
+	CommitTime string `json:"commit_time,omitempty"`
+	GoVersion  string `json:"go_version"`
+}
+
+// Get returns the build information, falling back to the VCS stamp the go
+// command embeds when the commit was not injected
+func Get() Build {
+	b := Build{Commit: Commit, BuildTime: BuildTime, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time":
+				b.CommitTime = s.Value
+			}
+		}
+	}
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.BuildTime == "" {
+		b.BuildTime = "unknown"
+	}
+	return b
+}
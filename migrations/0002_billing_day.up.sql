@@ -0,0 +1,2 @@
+-- Day of month the subscription is charged on
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS billing_day SMALLINT NOT NULL DEFAULT 1 CHECK (billing_day BETWEEN 1 AND 31);
@@ -0,0 +1,4 @@
+-- Last free month of a trial (inclusive), excluded from aggregation
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS trial_end DATE;
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_trial_end ON subscriptions(trial_end) WHERE trial_end IS NOT NULL;
@@ -0,0 +1,10 @@
+-- Months in which a subscription is paused and not charged (end_date NULL = until resumed)
+CREATE TABLE IF NOT EXISTS subscription_pauses (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    start_date DATE NOT NULL,
+    end_date DATE,
+    CHECK (end_date IS NULL OR end_date >= start_date)
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscription_pauses_subscription ON subscription_pauses(subscription_id);
@@ -0,0 +1,11 @@
+-- Price schedule: each price applies from effective_from until the next one
+CREATE TABLE IF NOT EXISTS subscription_prices (
+    subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    effective_from DATE NOT NULL,
+    price INTEGER NOT NULL,
+    PRIMARY KEY (subscription_id, effective_from)
+);
+
+INSERT INTO subscription_prices (subscription_id, effective_from, price)
+SELECT id, start_date, price FROM subscriptions s
+WHERE NOT EXISTS (SELECT 1 FROM subscription_prices p WHERE p.subscription_id = s.id);
@@ -0,0 +1,12 @@
+-- Back to whole rubles. Refused while any price has kopecks, those would be
+-- rounded away; change such prices to whole rubles first
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM subscriptions WHERE price % 100 <> 0)
+        OR EXISTS (SELECT 1 FROM subscription_prices WHERE price % 100 <> 0) THEN
+        RAISE EXCEPTION 'prices with kopecks cannot be stored in whole rubles';
+    END IF;
+END $$;
+
+ALTER TABLE subscription_prices ALTER COLUMN price TYPE INTEGER USING price / 100;
+ALTER TABLE subscriptions ALTER COLUMN price TYPE INTEGER USING price / 100;
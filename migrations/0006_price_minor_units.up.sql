@@ -0,0 +1,3 @@
+-- Store prices in minor units (kopecks) instead of whole rubles
+ALTER TABLE subscriptions ALTER COLUMN price TYPE BIGINT USING price * 100;
+ALTER TABLE subscription_prices ALTER COLUMN price TYPE BIGINT USING price * 100;
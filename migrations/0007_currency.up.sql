@@ -0,0 +1,9 @@
+-- Currency of the subscription price and ECB-style exchange rates (units of currency per 1 EUR)
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'RUB';
+
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    date DATE NOT NULL,
+    currency CHAR(3) NOT NULL,
+    rate NUMERIC(18,6) NOT NULL CHECK (rate > 0),
+    PRIMARY KEY (currency, date)
+);
@@ -0,0 +1,2 @@
+-- Optional discount: {"percent"|"amount"|"price": ..., "months": N}
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS discount JSONB;
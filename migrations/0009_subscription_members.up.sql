@@ -0,0 +1,12 @@
+-- Shared subscriptions: members pay part of the price to the owner
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS split TEXT NOT NULL DEFAULT 'equal' CHECK (split IN ('equal', 'percent', 'fixed'));
+
+CREATE TABLE IF NOT EXISTS subscription_members (
+    subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL,
+    percent SMALLINT CHECK (percent BETWEEN 1 AND 100),
+    amount BIGINT CHECK (amount >= 0),
+    PRIMARY KEY (subscription_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscription_members_user ON subscription_members(user_id);
@@ -0,0 +1,13 @@
+-- Tags (categories) of subscriptions, many-to-many
+CREATE TABLE IF NOT EXISTS tags (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS subscription_tags (
+    subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    tag_id UUID NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+    PRIMARY KEY (subscription_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscription_tags_tag ON subscription_tags(tag_id);
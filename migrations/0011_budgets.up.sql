@@ -0,0 +1,12 @@
+-- Monthly budgets per user: overall, per category (tag) or per service
+CREATE TABLE IF NOT EXISTS budgets (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL,
+    category TEXT,
+    service_name TEXT,
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL DEFAULT 'RUB',
+    CHECK (category IS NULL OR service_name IS NULL)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_budgets_scope ON budgets(user_id, COALESCE(category, ''), COALESCE(service_name, ''));
@@ -0,0 +1,35 @@
+-- Service catalog: canonical names, normalized aliases and default prices
+CREATE TABLE IF NOT EXISTS services (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL UNIQUE,
+    default_price BIGINT CHECK (default_price >= 0),
+    currency CHAR(3) NOT NULL DEFAULT 'RUB'
+);
+
+-- lower case with single spaces, see model.ServiceKey
+CREATE TABLE IF NOT EXISTS service_aliases (
+    alias TEXT PRIMARY KEY,
+    service_id UUID NOT NULL REFERENCES services(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_service_aliases_service ON service_aliases(service_id);
+
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS service_id UUID REFERENCES services(id);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_service ON subscriptions(service_id);
+
+-- backfill: one service per normalized name of existing subscriptions
+INSERT INTO services (name)
+    SELECT min(btrim(service_name)) FROM subscriptions s
+    WHERE s.service_id IS NULL AND NOT EXISTS (
+        SELECT 1 FROM service_aliases a WHERE a.alias = lower(regexp_replace(btrim(s.service_name), '\s+', ' ', 'g')))
+    GROUP BY lower(regexp_replace(btrim(s.service_name), '\s+', ' ', 'g'))
+    ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO service_aliases (alias, service_id)
+    SELECT lower(regexp_replace(btrim(name), '\s+', ' ', 'g')), id FROM services
+    ON CONFLICT DO NOTHING;
+
+-- service_name keeps the name as entered, the canonical one is read from services
+UPDATE subscriptions s SET service_id = a.service_id
+    FROM service_aliases a
+    WHERE s.service_id IS NULL AND a.alias = lower(regexp_replace(btrim(s.service_name), '\s+', ' ', 'g'));
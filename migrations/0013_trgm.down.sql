@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_subscriptions_service_name_trgm;
+DROP INDEX IF EXISTS idx_service_aliases_trgm;
@@ -0,0 +1,15 @@
+-- Fuzzy service search; without pg_trgm it falls back to substring matching
+DO $$
+BEGIN
+    CREATE EXTENSION IF NOT EXISTS pg_trgm;
+EXCEPTION WHEN OTHERS THEN
+    RAISE NOTICE 'pg_trgm is not available: %', SQLERRM;
+END $$;
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm') THEN
+        CREATE INDEX IF NOT EXISTS idx_service_aliases_trgm ON service_aliases USING gin (alias gin_trgm_ops);
+        CREATE INDEX IF NOT EXISTS idx_subscriptions_service_name_trgm ON subscriptions USING gin (service_name gin_trgm_ops);
+    END IF;
+END $$;
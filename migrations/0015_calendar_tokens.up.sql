@@ -0,0 +1,6 @@
+-- Secret tokens of the calendar feed URLs, one per user; only a hash is stored
+CREATE TABLE IF NOT EXISTS calendar_tokens (
+    user_id UUID PRIMARY KEY,
+    hash BYTEA NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);